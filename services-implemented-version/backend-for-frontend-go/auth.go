@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ownerAttribute identifies the team behind an API key on spans and in baggage. The key itself
+// is never recorded.
+const ownerAttribute = "app.api_key.owner"
+
+var (
+	errUnauthorized  = &apiError{Status: http.StatusUnauthorized, Code: "unauthorized", Title: "A valid API key is required"}
+	errQuotaExceeded = &apiError{Status: http.StatusTooManyRequests, Code: "quota_exceeded", Title: "This API key has used up its daily quota"}
+)
+
+// authenticator checks API keys and their daily quotas.
+type authenticator struct {
+	store    keyStore
+	rejected metric.Int64Counter
+}
+
+func newAuthenticator(store keyStore) *authenticator {
+	a := &authenticator{store: store}
+	a.rejected, _ = otel.Meter("backend-for-frontend").Int64Counter("app.api_key.rejected",
+		metric.WithDescription("Requests rejected for a missing or unknown API key, or an exhausted quota"))
+	return a
+}
+
+// apiKeyContextKey carries the API key auth accepted for a request.
+type apiKeyContextKey struct{}
+
+// acceptedKey is an API key auth has looked up, by its hash.
+type acceptedKey struct {
+	hash string
+	key  apiKey
+}
+
+// authenticatedKey returns the hash of the request's API key, if auth checked it.
+func authenticatedKey(ctx context.Context) (string, bool) {
+	accepted, ok := ctx.Value(apiKeyContextKey{}).(acceptedKey)
+	return accepted.hash, ok
+}
+
+// auth is set up by main. Without a key store, every request is let through.
+var auth = newAuthenticator(nil)
+
+// bearerToken reads the API key from the Authorization header. EventSource can't set headers,
+// so GET requests, such as the event stream, may pass it as the access_token query parameter
+// instead. The query never reaches telemetry, which only records the path.
+func bearerToken(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return token
+	}
+	if r.Method == http.MethodGet {
+		return r.URL.Query().Get("access_token")
+	}
+	return ""
+}
+
+// middleware lets through requests with a known key. Like the rate limiter, it goes inside
+// otelhttp so that the decision is recorded on the server span. It doesn't count the request
+// against the key's quota; quota does that, once the request is sure to run.
+func (a *authenticator) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.store == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx := r.Context()
+		span := trace.SpanFromContext(ctx)
+
+		token := bearerToken(r)
+		keyHash := hashKey(token)
+		key, ok, err := a.store.Lookup(ctx, keyHash)
+		if err != nil {
+			writeProblem(ctx, w, r, err)
+			return
+		}
+		if token == "" || !ok {
+			span.SetAttributes(attribute.Bool("app.api_key.valid", false))
+			a.rejected.Add(ctx, 1, metric.WithAttributes(attribute.String("app.api_key.reason", "unauthorized")))
+			w.Header().Set("WWW-Authenticate", `Bearer realm="memes"`)
+			writeProblem(ctx, w, r, errUnauthorized)
+			return
+		}
+		span.SetAttributes(attribute.Bool("app.api_key.valid", true), attribute.String(ownerAttribute, key.Owner))
+		ctx = withBaggage(ctx, ownerAttribute, key.Owner)
+		ctx = context.WithValue(ctx, apiKeyContextKey{}, acceptedKey{hash: keyHash, key: key})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// quota counts the request against its key's daily quota, as many times as it costs, or rejects
+// it once that is used up.
+// It goes inside the idempotency replay and the rate limiter, so neither a replayed response
+// nor a 429 costs quota.
+func (a *authenticator) quota(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		accepted, ok := ctx.Value(apiKeyContextKey{}).(acceptedKey)
+		if a.store == nil || !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		span := trace.SpanFromContext(ctx)
+		key := accepted.key
+
+		now := time.Now().UTC()
+		used, allowed, err := a.store.Use(ctx, accepted.hash, now.Format(time.DateOnly), int64(requestCost(ctx)), key.DailyQuota)
+		if err != nil {
+			writeProblem(ctx, w, r, err)
+			return
+		}
+		span.SetAttributes(attribute.Int64("app.api_key.used_today", used))
+		if key.DailyQuota > 0 {
+			w.Header().Set("X-Quota-Limit", strconv.FormatInt(key.DailyQuota, 10))
+			w.Header().Set("X-Quota-Remaining", strconv.FormatInt(max(key.DailyQuota-used, 0), 10))
+		}
+		if !allowed {
+			a.rejected.Add(ctx, 1, metric.WithAttributes(
+				attribute.String("app.api_key.reason", "quota_exceeded"),
+				attribute.String(ownerAttribute, key.Owner),
+			))
+			midnight := now.Truncate(24 * time.Hour).Add(24 * time.Hour)
+			w.Header().Set("Retry-After", strconv.Itoa(int(midnight.Sub(now).Seconds())+1))
+			writeProblem(ctx, w, r, errQuotaExceeded)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// authenticated puts handler behind auth with the given key store, as main does.
+func authenticated(t *testing.T, spec string) http.Handler {
+	t.Helper()
+	store, err := newMemoryKeyStore(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := newAuthenticator(store)
+	return a.middleware(a.quota(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})))
+}
+
+func TestAuthRequiresAKnownKey(t *testing.T) {
+	handler := authenticated(t, "team:secret")
+	for _, tt := range []struct {
+		name   string
+		method string
+		target string
+		header string
+		want   int
+	}{
+		{"no key", http.MethodPost, "/createPicture", "", http.StatusUnauthorized},
+		{"unknown key", http.MethodPost, "/createPicture", "Bearer guess", http.StatusUnauthorized},
+		{"not a bearer token", http.MethodPost, "/createPicture", "Basic c2VjcmV0", http.StatusUnauthorized},
+		{"key", http.MethodPost, "/createPicture", "Bearer secret", http.StatusNoContent},
+		{"query key for the stream", http.MethodGet, "/createPicture/stream?access_token=secret", "", http.StatusNoContent},
+		{"query key only for GET", http.MethodPost, "/createPicture?access_token=secret", "", http.StatusUnauthorized},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.target, nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+			if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+				t.Error("a 401 without WWW-Authenticate")
+			}
+		})
+	}
+}
+
+func TestAuthEnforcesTheDailyQuota(t *testing.T) {
+	handler := authenticated(t, "team:secret:2")
+	send := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/createPicture", nil)
+		r.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	for i, remaining := range []string{"1", "0"} {
+		w := send()
+		if w.Code != http.StatusNoContent || w.Header().Get("X-Quota-Remaining") != remaining {
+			t.Fatalf("request %d: %d with %s remaining, want 204 with %s", i, w.Code, w.Header().Get("X-Quota-Remaining"), remaining)
+		}
+	}
+	w := send()
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d past the quota, want 429", w.Code)
+	}
+	// Retry-After points at midnight UTC, at most a day away.
+	retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After"))
+	if err != nil || retryAfter < 1 || retryAfter > 24*60*60+1 {
+		t.Errorf("Retry-After = %q, want the seconds until midnight", w.Header().Get("Retry-After"))
+	}
+	if w.Header().Get("X-Quota-Limit") != "2" {
+		t.Errorf("X-Quota-Limit = %q, want 2", w.Header().Get("X-Quota-Limit"))
+	}
+}
+
+func TestAuthChargesABatchPerMeme(t *testing.T) {
+	handler := authenticated(t, "team:secret:10")
+	r := httptest.NewRequest(http.MethodPost, "/createPictures", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	r = r.WithContext(withCost(r.Context(), 8))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusNoContent || w.Header().Get("X-Quota-Remaining") != "2" {
+		t.Errorf("got %d with %s remaining, want 204 with 2", w.Code, w.Header().Get("X-Quota-Remaining"))
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// batchConfig bounds POST /createPictures.
+type batchConfig struct {
+	MaxItems    int
+	Concurrency int
+}
+
+// batchConfigFromEnv reads the BATCH_* environment variables, falling back to defaults.
+func batchConfigFromEnv() batchConfig {
+	return batchConfig{
+		MaxItems:    max(envInt("BATCH_MAX_ITEMS", 50), 1),
+		Concurrency: max(envInt("BATCH_CONCURRENCY", 4), 1),
+	}
+}
+
+var batches = batchConfigFromEnv()
+
+// createPicturesRequest asks for either Count random memes or one meme per entry in Items.
+type createPicturesRequest struct {
+	Count int                    `json:"count,omitempty"`
+	Items []createPictureRequest `json:"items,omitempty"`
+	// Format is "json" for a manifest of links, or "zip" for the pictures themselves.
+	// Without it, the Accept header decides.
+	Format string `json:"format,omitempty"`
+}
+
+// batchItem is one line of the manifest. URL is the meme's permalink when it was saved to the
+// gallery. Otherwise it is the job's /memes/{id}/image link, which only lasts as long as the job
+// keeps its image, and Permanent is false to say so.
+type batchItem struct {
+	Index     int      `json:"index"`
+	Status    string   `json:"status"`
+	ID        string   `json:"id,omitempty"`
+	URL       string   `json:"url,omitempty"`
+	Permanent bool     `json:"permanent"`
+	File      string   `json:"file,omitempty"`
+	Phrase    string   `json:"phrase,omitempty"`
+	ImageURL  string   `json:"imageUrl,omitempty"`
+	Seed      int64    `json:"seed"`
+	Degraded  []string `json:"degraded,omitempty"`
+	Error     *problem `json:"error,omitempty"`
+
+	result *cachedMeme
+}
+
+type batchManifest struct {
+	TraceID   string      `json:"traceId"`
+	Succeeded int         `json:"succeeded"`
+	Failed    int         `json:"failed"`
+	Items     []batchItem `json:"items"`
+}
+
+// weighBatch makes a batch cost as many rate limit tokens and as much quota as the memes it asks
+// for. It goes outside the metering middleware, and reads the body ahead of the handler.
+func weighBatch(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			writeProblem(r.Context(), w, r, &requestError{err})
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		var size struct {
+			Count int               `json:"count"`
+			Items []json.RawMessage `json:"items"`
+		}
+		// A body that doesn't parse is rejected by the handler, at the cost of one.
+		cost := 1
+		if json.Unmarshal(body, &size) == nil {
+			cost = min(max(size.Count, len(size.Items), 1), batches.MaxItems)
+		}
+		next.ServeHTTP(w, r.WithContext(withCost(r.Context(), cost)))
+	})
+}
+
+func parseCreatePicturesRequest(r *http.Request) (createPicturesRequest, error) {
+	var req createPicturesRequest
+	decoder := json.NewDecoder(io.LimitReader(r.Body, 1<<20))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		return req, &requestError{fmt.Errorf("invalid request body: %w", err)}
+	}
+	if (req.Count == 0) == (len(req.Items) == 0) {
+		return req, &requestError{errors.New("set exactly one of count and items")}
+	}
+	if req.Count < 0 || req.Count > batches.MaxItems || len(req.Items) > batches.MaxItems {
+		return req, &requestError{fmt.Errorf("a batch holds between 1 and %d memes", batches.MaxItems)}
+	}
+	if req.Format == "" {
+		req.Format = "json"
+		if strings.Contains(r.Header.Get("Accept"), "application/zip") {
+			req.Format = "zip"
+		}
+	}
+	if req.Format != "json" && req.Format != "zip" {
+		return req, &requestError{errors.New("format must be json or zip")}
+	}
+	if req.Count > 0 {
+		req.Items = make([]createPictureRequest, req.Count)
+	}
+	for i := range req.Items {
+		item := &req.Items[i]
+		item.Format = normalizeFormat(item.Format)
+		if err := item.validate(); err != nil {
+			return req, &requestError{fmt.Errorf("items[%d]: %w", i, err)}
+		}
+	}
+	return req, nil
+}
+
+// createPictures handles POST /createPictures. It renders a batch of memes, a few at a time,
+// and reports on every item even when some of them fail.
+func createPictures(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer("backend-for-frontend").Start(r.Context(), "createPictures")
+	defer span.End()
+
+	request, err := parseCreatePicturesRequest(r)
+	if err != nil {
+		writeProblem(ctx, w, r, err)
+		return
+	}
+	span.SetAttributes(
+		attribute.Int("app.batch.size", len(request.Items)),
+		attribute.String("app.batch.format", request.Format),
+	)
+
+	items := make([]batchItem, len(request.Items))
+	slots := make(chan struct{}, batches.Concurrency)
+	var wg sync.WaitGroup
+	for i := range request.Items {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			items[i] = renderBatchItem(ctx, r, i, request.Items[i])
+		}()
+	}
+	wg.Wait()
+
+	manifest := batchManifest{TraceID: span.SpanContext().TraceID().String(), Items: items}
+	for _, item := range items {
+		if item.Error != nil {
+			manifest.Failed++
+		} else {
+			manifest.Succeeded++
+		}
+	}
+	span.SetAttributes(
+		attribute.Int("app.batch.succeeded", manifest.Succeeded),
+		attribute.Int("app.batch.failed", manifest.Failed),
+	)
+	if manifest.Failed > 0 {
+		span.SetStatus(codes.Error, fmt.Sprintf("%d of %d memes failed", manifest.Failed, len(items)))
+	}
+
+	if request.Format == "zip" {
+		writeBatchZip(ctx, w, manifest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(manifest)
+}
+
+// renderBatchItem makes one meme of the batch in a child span of its own.
+func renderBatchItem(ctx context.Context, r *http.Request, index int, request createPictureRequest) batchItem {
+	ctx, span := otel.Tracer("backend-for-frontend").Start(ctx, "createPictures.item",
+		trace.WithAttributes(attribute.Int("app.batch.index", index)))
+	defer span.End()
+
+	ctx = request.ensureSeed(ctx)
+	item := batchItem{Index: index, Seed: *request.Seed}
+
+	inputs, err := pickInputs(ctx, request, nil)
+	var result *cachedMeme
+	if err == nil {
+		item.Phrase, item.ImageURL = inputs.Phrase, inputs.ImageURL
+		result, err = renderMeme(ctx, inputs, nil)
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		p := newProblem(span, r.URL.Path, err)
+		item.Status = "failed"
+		item.Error = &p
+		return item
+	}
+
+	job := jobs.record(ctx, request, inputs, result)
+	item.Status = "ok"
+	item.ID = job.id
+	item.URL = job.imageURL(r)
+	item.Permanent = job.isSaved()
+	item.Degraded = inputs.degraded.list()
+	item.result = result
+	return item
+}
+
+// writeBatchZip sends the pictures with the manifest alongside them as manifest.json.
+func writeBatchZip(ctx context.Context, w http.ResponseWriter, manifest batchManifest) {
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="memes.zip"`)
+	archive := zip.NewWriter(w)
+	for i, item := range manifest.Items {
+		if item.result == nil {
+			continue
+		}
+		name := fmt.Sprintf("meme-%03d%s", item.Index, fileExtension(item.result.ContentType))
+		manifest.Items[i].File = name
+		if f, err := archive.Create(name); err == nil {
+			f.Write(item.result.Data)
+		}
+	}
+	if f, err := archive.Create("manifest.json"); err == nil {
+		encoder := json.NewEncoder(f)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(manifest)
+	}
+	if err := archive.Close(); err != nil {
+		trace.SpanFromContext(ctx).RecordError(err)
+	}
+}
+
+// fileExtension names a picture's file after its format, as in imageFormats. Other types, such
+// as a fallback source image's, get whatever extension the system knows them by.
+func fileExtension(contentType string) string {
+	if format := formatOf(contentType); format != "" {
+		return "." + format
+	}
+	if extensions, err := mime.ExtensionsByType(contentType); err == nil && len(extensions) > 0 {
+		return extensions[0]
+	}
+	return ""
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const batchImageURL = "https://random-pictures.s3.amazonaws.com/cat.png"
+
+// fakeMeminator renders a meme as its phrase, slowly enough for renders to overlap, and turns
+// away the phrase "fail". It counts how many renders it has going at once.
+type fakeMeminator struct {
+	mu      sync.Mutex
+	running int
+	most    int
+}
+
+func (m *fakeMeminator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Phrase string `json:"phrase"`
+	}
+	json.NewDecoder(r.Body).Decode(&request)
+	if request.Phrase == "fail" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	m.mu.Lock()
+	m.running++
+	m.most = max(m.most, m.running)
+	m.mu.Unlock()
+	time.Sleep(20 * time.Millisecond)
+	m.mu.Lock()
+	m.running--
+	m.mu.Unlock()
+	w.Header().Set("Content-Type", "image/png")
+	io.WriteString(w, request.Phrase)
+}
+
+// withFakeMeminator points the batch at a fakeMeminator, with nothing cached, no fallbacks and
+// a job queue of its own.
+func withFakeMeminator(t *testing.T, concurrency int) *fakeMeminator {
+	fake := &fakeMeminator{}
+	server := httptest.NewServer(fake)
+	savedURL, savedFallbacks, savedMemes, savedJobs, savedBatches := meminator.url, fallbacks, memes, jobs, batches
+	t.Cleanup(func() {
+		server.Close()
+		meminator.url, fallbacks, memes, jobs, batches = savedURL, savedFallbacks, savedMemes, savedJobs, savedBatches
+	})
+	meminator.url = server.URL
+	fallbacks.Picture = false
+	memes = newMemeCache(cacheConfig{MaxEntries: 100, MaxBytes: 1 << 20})
+	jobs = testJobQueue(jobConfig{})
+	batches = batchConfig{MaxItems: 10, Concurrency: concurrency}
+	return fake
+}
+
+func postBatch(body, accept string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/createPictures", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	if accept != "" {
+		r.Header.Set("Accept", accept)
+	}
+	w := httptest.NewRecorder()
+	createPictures(w, r)
+	return w
+}
+
+// batchOf asks for one meme per phrase, all on the same picture.
+func batchOf(format string, phrases ...string) string {
+	items := make([]map[string]string, len(phrases))
+	for i, phrase := range phrases {
+		items[i] = map[string]string{"phrase": phrase, "imageUrl": batchImageURL}
+	}
+	body, _ := json.Marshal(map[string]interface{}{"items": items, "format": format})
+	return string(body)
+}
+
+func TestCreatePicturesBoundsConcurrency(t *testing.T) {
+	fake := withFakeMeminator(t, 2)
+	w := postBatch(batchOf("json", "a", "b", "c", "d", "e", "f"), "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+	}
+	if fake.most != 2 {
+		t.Errorf("meminator rendered up to %d memes at once, want BATCH_CONCURRENCY's 2", fake.most)
+	}
+}
+
+func TestCreatePicturesReportsEveryItem(t *testing.T) {
+	withFakeMeminator(t, 4)
+	w := postBatch(batchOf("json", "a", "fail", "c"), "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200 even though an item failed", w.Code)
+	}
+	var manifest batchManifest
+	if err := json.NewDecoder(w.Body).Decode(&manifest); err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Succeeded != 2 || manifest.Failed != 1 || len(manifest.Items) != 3 {
+		t.Fatalf("manifest = %+v, want 2 of 3 succeeded", manifest)
+	}
+	for i, item := range manifest.Items {
+		if item.Index != i {
+			t.Errorf("items[%d].index = %d", i, item.Index)
+		}
+	}
+	failed := manifest.Items[1]
+	if failed.Status != "failed" || failed.Error == nil || failed.URL != "" {
+		t.Errorf("the failed item = %+v, want a failure with its problem and no link", failed)
+	}
+	ok := manifest.Items[0]
+	if ok.Status != "ok" || ok.Phrase != "a" || ok.URL != "/memes/"+ok.ID+"/image" {
+		t.Errorf("the first item = %+v, want its job's image link", ok)
+	}
+	// With the gallery off, the link lasts only as long as the job keeps the image.
+	if ok.Permanent {
+		t.Error("a link to an unsaved meme claims to be permanent")
+	}
+}
+
+func TestCreatePicturesMarksSavedMemesPermanent(t *testing.T) {
+	withFakeMeminator(t, 4)
+	store, err := newFileStore(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := gallery
+	gallery = store
+	defer func() { gallery = saved }()
+
+	w := postBatch(batchOf("json", "a"), "")
+	var manifest batchManifest
+	if err := json.NewDecoder(w.Body).Decode(&manifest); err != nil {
+		t.Fatal(err)
+	}
+	if item := manifest.Items[0]; !item.Permanent || strings.HasSuffix(item.URL, "/image") {
+		t.Errorf("the saved item = %+v, want its permalink, marked permanent", item)
+	}
+}
+
+func TestCreatePicturesZip(t *testing.T) {
+	withFakeMeminator(t, 4)
+	w := postBatch(batchOf("", "a", "fail", "c"), "application/zip")
+	if got := w.Header().Get("Content-Type"); got != "application/zip" {
+		t.Fatalf("Content-Type = %q, want a zip for Accept: application/zip", got)
+	}
+	archive, err := zip.NewReader(strings.NewReader(w.Body.String()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{}
+	for _, f := range archive.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(r)
+		r.Close()
+		files[f.Name] = string(data)
+	}
+	if len(files) != 3 || files["meme-000.png"] != "a" || files["meme-002.png"] != "c" {
+		t.Errorf("zip holds %v, want meme-000.png, meme-002.png and manifest.json", files)
+	}
+
+	var manifest batchManifest
+	if err := json.Unmarshal([]byte(files["manifest.json"]), &manifest); err != nil {
+		t.Fatalf("manifest.json: %v", err)
+	}
+	if manifest.Items[0].File != "meme-000.png" || manifest.Items[1].File != "" || manifest.Failed != 1 {
+		t.Errorf("manifest = %+v, want files named for the memes that were made", manifest)
+	}
+}
+
+func TestParseCreatePicturesRequest(t *testing.T) {
+	saved := batches
+	batches = batchConfig{MaxItems: 3, Concurrency: 1}
+	defer func() { batches = saved }()
+
+	for _, tt := range []struct {
+		name   string
+		body   string
+		accept string
+		format string // "" when the request is refused
+		items  int
+	}{
+		{"count", `{"count":2}`, "", "json", 2},
+		{"items", batchOf("", "a"), "", "json", 1},
+		{"zip from Accept", `{"count":1}`, "application/zip", "zip", 1},
+		{"format wins over Accept", `{"count":1,"format":"json"}`, "application/zip", "json", 1},
+		{"neither", `{}`, "", "", 0},
+		{"both", `{"count":1,"items":[{}]}`, "", "", 0},
+		{"too many", `{"count":4}`, "", "", 0},
+		{"negative", `{"count":-1}`, "", "", 0},
+		{"unknown format", `{"count":1,"format":"tar"}`, "", "", 0},
+		{"unknown field", `{"count":1,"size":2}`, "", "", 0},
+		{"invalid item", `{"items":[{"imageUrl":"https://example.com/cat.png"}]}`, "", "", 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/createPictures", strings.NewReader(tt.body))
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			got, err := parseCreatePicturesRequest(r)
+			if tt.format == "" {
+				if err == nil {
+					t.Errorf("accepted %s", tt.body)
+				}
+				return
+			}
+			if err != nil || got.Format != tt.format || len(got.Items) != tt.items {
+				t.Errorf("got %s with %d items, %v, want %s with %d", got.Format, len(got.Items), err, tt.format, tt.items)
+			}
+		})
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type breakerState int
+
+const (
+	stateClosed breakerState = iota
+	stateOpen
+	stateHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case stateOpen:
+		return "open"
+	case stateHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// breakerConfig sets when a circuit breaker opens and how it recovers.
+type breakerConfig struct {
+	FailureThreshold int           // consecutive failures that open the breaker
+	OpenDuration     time.Duration // how long to fail fast before probing again
+	HalfOpenRequests int           // concurrent probe requests allowed while half-open
+}
+
+// breakerConfigFromEnv reads the BREAKER_* environment variables, falling back to defaults.
+func breakerConfigFromEnv() breakerConfig {
+	return breakerConfig{
+		FailureThreshold: envInt("BREAKER_FAILURE_THRESHOLD", 5),
+		OpenDuration:     envDuration("BREAKER_OPEN_DURATION", 30*time.Second),
+		HalfOpenRequests: envInt("BREAKER_HALF_OPEN_REQUESTS", 1),
+	}
+}
+
+// breakerOpenError is returned without calling the service while its breaker is open.
+type breakerOpenError struct {
+	service string
+}
+
+func (e *breakerOpenError) Error() string {
+	return fmt.Sprintf("%s is unavailable: circuit breaker is open", e.service)
+}
+
+// circuitBreaker stops calling a service that keeps failing, then lets a few probe requests
+// through after OpenDuration to find out whether it has recovered.
+type circuitBreaker struct {
+	service     string
+	config      breakerConfig
+	transitions metric.Int64Counter
+
+	mu         sync.Mutex
+	state      breakerState
+	generation uint64 // counts transitions, so results from an earlier state can be told apart
+	failures   int
+	probes     int
+	changed    time.Time
+}
+
+// breakerTicket is what allow hands an allowed call: the state it was let through in.
+type breakerTicket struct {
+	generation uint64
+	probe      bool
+}
+
+func newCircuitBreaker(service string, config breakerConfig) *circuitBreaker {
+	b := &circuitBreaker{service: service, config: config, changed: time.Now()}
+
+	meter := otel.Meter("backend-for-frontend")
+	b.transitions, _ = meter.Int64Counter("app.circuit_breaker.transitions",
+		metric.WithDescription("Circuit breaker state changes"))
+	meter.Int64ObservableGauge("app.circuit_breaker.state",
+		metric.WithDescription("Circuit breaker state: 0 closed, 1 open, 2 half-open"),
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			o.Observe(int64(b.State()), metric.WithAttributes(attribute.String("peer.service", service)))
+			return nil
+		}))
+	return b
+}
+
+// allow reports whether a call may go ahead. Every allowed call must be followed by record,
+// with the ticket allow returned.
+func (b *circuitBreaker) allow(ctx context.Context) (breakerTicket, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == stateOpen && time.Since(b.changed) >= b.config.OpenDuration {
+		b.transition(ctx, stateHalfOpen)
+	}
+	ticket := breakerTicket{generation: b.generation}
+	switch b.state {
+	case stateOpen:
+		return ticket, &breakerOpenError{service: b.service}
+	case stateHalfOpen:
+		if b.probes >= b.config.HalfOpenRequests {
+			return ticket, &breakerOpenError{service: b.service}
+		}
+		b.probes++
+		ticket.probe = true
+	}
+	return ticket, nil
+}
+
+// record reports the outcome of an allowed call. A nil err is a success. Cancellation by
+// our own caller says nothing about the service's health, so it is not counted. Nor is a call
+// let through before the breaker last changed state: only the probes decide a half-open breaker.
+func (b *circuitBreaker) record(ctx context.Context, ticket breakerTicket, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ticket.generation != b.generation {
+		return
+	}
+	ignored := errors.Is(err, context.Canceled)
+	switch b.state {
+	case stateClosed:
+		if ignored {
+			return
+		}
+		if err == nil {
+			b.failures = 0
+			return
+		}
+		b.failures++
+		if b.failures >= b.config.FailureThreshold {
+			b.transition(ctx, stateOpen)
+		}
+	case stateHalfOpen:
+		if !ticket.probe {
+			return
+		}
+		b.probes--
+		if ignored {
+			return
+		}
+		if err == nil {
+			b.transition(ctx, stateClosed)
+		} else {
+			b.transition(ctx, stateOpen)
+		}
+	}
+}
+
+// transition must be called with mu held.
+func (b *circuitBreaker) transition(ctx context.Context, to breakerState) {
+	from := b.state
+	b.state = to
+	b.generation++
+	b.failures = 0
+	b.probes = 0
+	b.changed = time.Now()
+
+	attrs := []attribute.KeyValue{
+		attribute.String("peer.service", b.service),
+		attribute.String("app.circuit_breaker.from", from.String()),
+		attribute.String("app.circuit_breaker.to", to.String()),
+	}
+	trace.SpanFromContext(ctx).AddEvent("circuit breaker state change", trace.WithAttributes(attrs...))
+	b.transitions.Add(ctx, 1, metric.WithAttributes(attrs...))
+}
+
+func (b *circuitBreaker) State() breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+type breakerStatus struct {
+	State    string    `json:"state"`
+	Failures int       `json:"failures"`
+	Since    time.Time `json:"since"`
+}
+
+func (b *circuitBreaker) status() breakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return breakerStatus{State: b.state.String(), Failures: b.failures, Since: b.changed}
+}
+
+// breakerStates reports the current state of every downstream service's circuit breaker.
+func breakerStates(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	states := map[string]breakerStatus{}
+	for _, service := range []*downstream{phrasePicker, imagePicker, meminator, imageSource} {
+		states[service.name] = service.breaker.status()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(states)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+var errDown = errors.New("service is down")
+
+func testBreaker() *circuitBreaker {
+	return newCircuitBreaker("test", breakerConfig{
+		FailureThreshold: 3,
+		OpenDuration:     10 * time.Millisecond,
+		HalfOpenRequests: 1,
+	})
+}
+
+// trip fails calls until the breaker opens, then waits until it will let a probe through.
+func trip(t *testing.T, b *circuitBreaker) {
+	t.Helper()
+	ctx := context.Background()
+	for i := 0; i < b.config.FailureThreshold; i++ {
+		ticket, err := b.allow(ctx)
+		if err != nil {
+			t.Fatalf("call %d refused while closed: %v", i, err)
+		}
+		b.record(ctx, ticket, errDown)
+	}
+	if got := b.State(); got != stateOpen {
+		t.Fatalf("state = %s after %d failures, want open", got, b.config.FailureThreshold)
+	}
+	time.Sleep(b.config.OpenDuration)
+}
+
+func TestBreakerOpensAfterConsecutiveFailures(t *testing.T) {
+	b := testBreaker()
+	ctx := context.Background()
+
+	// A success in between starts the count again.
+	for _, err := range []error{errDown, errDown, nil, errDown, errDown} {
+		ticket, _ := b.allow(ctx)
+		b.record(ctx, ticket, err)
+	}
+	if got := b.State(); got != stateClosed {
+		t.Fatalf("state = %s, want closed", got)
+	}
+
+	ticket, _ := b.allow(ctx)
+	b.record(ctx, ticket, errDown)
+	if got := b.State(); got != stateOpen {
+		t.Fatalf("state = %s, want open", got)
+	}
+	var open *breakerOpenError
+	if _, err := b.allow(ctx); !errors.As(err, &open) {
+		t.Errorf("allow = %v while open, want a breakerOpenError", err)
+	}
+}
+
+func TestBreakerIgnoresCancellation(t *testing.T) {
+	b := testBreaker()
+	ctx := context.Background()
+	for i := 0; i < 2*b.config.FailureThreshold; i++ {
+		ticket, _ := b.allow(ctx)
+		b.record(ctx, ticket, context.Canceled)
+	}
+	if got := b.State(); got != stateClosed {
+		t.Errorf("state = %s after cancelled calls, want closed", got)
+	}
+}
+
+func TestBreakerProbes(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		result error
+		want   breakerState
+	}{
+		{"success closes", nil, stateClosed},
+		{"failure reopens", errDown, stateOpen},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			b := testBreaker()
+			ctx := context.Background()
+			trip(t, b)
+
+			probe, err := b.allow(ctx)
+			if err != nil {
+				t.Fatalf("probe refused: %v", err)
+			}
+			if got := b.State(); got != stateHalfOpen {
+				t.Fatalf("state = %s, want half-open", got)
+			}
+			if _, err := b.allow(ctx); err == nil {
+				t.Fatal("a second probe was let through")
+			}
+			b.record(ctx, probe, tt.result)
+			if got := b.State(); got != tt.want {
+				t.Errorf("state = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBreakerIgnoresCallsFromEarlierStates(t *testing.T) {
+	b := testBreaker()
+	ctx := context.Background()
+
+	// Let a call through while closed, and have it finish only after the breaker is half-open.
+	stale, err := b.allow(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trip(t, b)
+	probe, err := b.allow(ctx)
+	if err != nil {
+		t.Fatalf("probe refused: %v", err)
+	}
+
+	b.record(ctx, stale, nil)
+	if got := b.State(); got != stateHalfOpen {
+		t.Fatalf("state = %s after a stale success, want half-open until the probe answers", got)
+	}
+	b.record(ctx, stale, context.Canceled)
+	if _, err := b.allow(ctx); err == nil {
+		t.Fatal("a stale cancelled call freed a probe slot")
+	}
+
+	b.record(ctx, probe, errDown)
+	if got := b.State(); got != stateOpen {
+		t.Errorf("state = %s after the probe failed, want open", got)
+	}
+}
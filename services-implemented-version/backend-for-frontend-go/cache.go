@@ -0,0 +1,255 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// cacheConfig bounds the rendered-meme cache. The disk tier is off unless Dir is set.
+type cacheConfig struct {
+	MaxEntries   int
+	MaxBytes     int64
+	TTL          time.Duration
+	Dir          string
+	DiskMaxBytes int64
+}
+
+// cacheConfigFromEnv reads the CACHE_* environment variables, falling back to defaults.
+func cacheConfigFromEnv() cacheConfig {
+	return cacheConfig{
+		MaxEntries:   envInt("CACHE_MAX_ENTRIES", 100),
+		MaxBytes:     int64(envInt("CACHE_MAX_BYTES", 64<<20)),
+		TTL:          envDuration("CACHE_TTL", time.Hour),
+		Dir:          os.Getenv("CACHE_DIR"),
+		DiskMaxBytes: int64(envInt("CACHE_DISK_MAX_BYTES", 512<<20)),
+	}
+}
+
+// cachedMeme is one rendered picture.
+type cachedMeme struct {
+	Key         string    `json:"key"`
+	ContentType string    `json:"contentType"`
+	Created     time.Time `json:"created"`
+	Data        []byte    `json:"-"`
+}
+
+// memeCache is a content-addressed LRU cache of meminator's output, with an optional on-disk tier
+// for pictures that fall out of memory or survive a restart.
+type memeCache struct {
+	config  cacheConfig
+	lookups metric.Int64Counter
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List // most recently used at the front
+	bytes   int64
+}
+
+func newMemeCache(config cacheConfig) *memeCache {
+	c := &memeCache{
+		config:  config,
+		entries: map[string]*list.Element{},
+		order:   list.New(),
+	}
+	c.lookups, _ = otel.Meter("backend-for-frontend").Int64Counter("app.meme_cache.lookups",
+		metric.WithDescription("Rendered meme cache lookups, by result"))
+	if config.Dir != "" {
+		os.MkdirAll(config.Dir, 0o755)
+	}
+	return c
+}
+
+var memes = newMemeCache(cacheConfigFromEnv())
+
+// cacheKey identifies a meme by everything that affects how it is rendered.
+func cacheKey(phrase, imageURL string, style *memeStyle, format string) string {
+	h := sha256.New()
+	json.NewEncoder(h).Encode(struct {
+		Phrase   string     `json:"phrase"`
+		ImageURL string     `json:"imageUrl"`
+		Style    *memeStyle `json:"style"`
+		Format   string     `json:"format,omitempty"`
+	}{phrase, imageURL, style, format})
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// etagMatches reports whether an If-None-Match header matches etag.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// Get looks in memory, then on disk, and records the result on the span and as a metric.
+func (c *memeCache) Get(ctx context.Context, key string) (*cachedMeme, bool) {
+	meme, tier := c.getMemory(key)
+	if meme == nil {
+		meme, tier = c.getDisk(key)
+		if meme != nil {
+			c.putMemory(meme)
+		}
+	}
+
+	result := "miss"
+	if meme != nil {
+		result = "hit"
+	}
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.Bool("app.cache.hit", meme != nil),
+		attribute.String("app.cache.tier", tier),
+	)
+	c.lookups.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("app.cache.result", result),
+		attribute.String("app.cache.tier", tier),
+	))
+	return meme, meme != nil
+}
+
+// Put stores a rendered meme in memory and, if configured, on disk.
+func (c *memeCache) Put(meme *cachedMeme) {
+	c.putMemory(meme)
+	if c.config.Dir != "" {
+		c.putDisk(meme)
+	}
+}
+
+func (c *memeCache) expired(meme *cachedMeme) bool {
+	return c.config.TTL > 0 && time.Since(meme.Created) > c.config.TTL
+}
+
+func (c *memeCache) getMemory(key string) (*cachedMeme, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, ""
+	}
+	meme := element.Value.(*cachedMeme)
+	if c.expired(meme) {
+		c.remove(element)
+		return nil, ""
+	}
+	c.order.MoveToFront(element)
+	return meme, "memory"
+}
+
+func (c *memeCache) putMemory(meme *cachedMeme) {
+	if int64(len(meme.Data)) > c.config.MaxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[meme.Key]; ok {
+		c.remove(element)
+	}
+	c.entries[meme.Key] = c.order.PushFront(meme)
+	c.bytes += int64(len(meme.Data))
+	for c.order.Len() > c.config.MaxEntries || c.bytes > c.config.MaxBytes {
+		c.remove(c.order.Back())
+	}
+}
+
+// remove must be called with mu held.
+func (c *memeCache) remove(element *list.Element) {
+	meme := c.order.Remove(element).(*cachedMeme)
+	delete(c.entries, meme.Key)
+	c.bytes -= int64(len(meme.Data))
+}
+
+// On disk, each meme is a data file plus a .json file holding its metadata.
+func (c *memeCache) diskPaths(key string) (string, string) {
+	data := filepath.Join(c.config.Dir, key)
+	return data, data + ".json"
+}
+
+func (c *memeCache) getDisk(key string) (*cachedMeme, string) {
+	if c.config.Dir == "" {
+		return nil, ""
+	}
+	dataPath, metaPath := c.diskPaths(key)
+	meta, err := os.ReadFile(metaPath)
+	if err != nil {
+		return nil, ""
+	}
+	var meme cachedMeme
+	if err := json.Unmarshal(meta, &meme); err != nil || c.expired(&meme) {
+		os.Remove(dataPath)
+		os.Remove(metaPath)
+		return nil, ""
+	}
+	if meme.Data, err = os.ReadFile(dataPath); err != nil {
+		return nil, ""
+	}
+	return &meme, "disk"
+}
+
+func (c *memeCache) putDisk(meme *cachedMeme) {
+	dataPath, metaPath := c.diskPaths(meme.Key)
+	meta, err := json.Marshal(meme)
+	if err != nil {
+		return
+	}
+	if err := os.WriteFile(dataPath, meme.Data, 0o644); err != nil {
+		return
+	}
+	// The metadata goes last: a meme without it is never read back.
+	if err := os.WriteFile(metaPath, meta, 0o644); err != nil {
+		os.Remove(dataPath)
+		return
+	}
+	c.pruneDisk()
+}
+
+// pruneDisk deletes the oldest memes until the disk tier fits in DiskMaxBytes.
+func (c *memeCache) pruneDisk() {
+	entries, err := os.ReadDir(c.config.Dir)
+	if err != nil {
+		return
+	}
+	type file struct {
+		key      string
+		size     int64
+		modified time.Time
+	}
+	var files []file
+	var total int64
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, file{entry.Name(), info.Size(), info.ModTime()})
+		total += info.Size()
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].modified.Before(files[j].modified) })
+	for _, f := range files {
+		if total <= c.config.DiskMaxBytes {
+			break
+		}
+		dataPath, metaPath := c.diskPaths(f.key)
+		os.Remove(metaPath)
+		os.Remove(dataPath)
+		total -= f.size
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func meme(key string, size int) *cachedMeme {
+	return &cachedMeme{Key: key, ContentType: "image/png", Created: time.Now(), Data: []byte(strings.Repeat("x", size))}
+}
+
+func cached(c *memeCache, key string) bool {
+	_, ok := c.Get(context.Background(), key)
+	return ok
+}
+
+func TestMemeCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newMemeCache(cacheConfig{MaxEntries: 2, MaxBytes: 1 << 20})
+	c.Put(meme("a", 1))
+	c.Put(meme("b", 1))
+	cached(c, "a") // a is now more recent than b
+	c.Put(meme("c", 1))
+	if !cached(c, "a") || cached(c, "b") || !cached(c, "c") {
+		t.Errorf("kept %v, want a and c", c.entries)
+	}
+}
+
+func TestMemeCacheBoundsBytes(t *testing.T) {
+	c := newMemeCache(cacheConfig{MaxEntries: 10, MaxBytes: 10})
+	c.Put(meme("a", 4))
+	c.Put(meme("b", 4))
+	c.Put(meme("c", 4))
+	if cached(c, "a") || !cached(c, "b") || !cached(c, "c") || c.bytes != 8 {
+		t.Errorf("kept %d bytes in %v, want b and c's 8", c.bytes, c.entries)
+	}
+	c.Put(meme("huge", 11))
+	if cached(c, "huge") || c.bytes != 8 {
+		t.Error("a meme bigger than the whole cache pushed the others out")
+	}
+	// Putting a key again replaces it rather than counting it twice.
+	c.Put(meme("b", 2))
+	if c.bytes != 6 || c.order.Len() != 2 {
+		t.Errorf("%d entries of %d bytes after replacing b, want 2 of 6", c.order.Len(), c.bytes)
+	}
+}
+
+func TestMemeCacheExpires(t *testing.T) {
+	c := newMemeCache(cacheConfig{MaxEntries: 10, MaxBytes: 1 << 20, TTL: time.Minute})
+	old := meme("old", 1)
+	old.Created = time.Now().Add(-2 * time.Minute)
+	c.Put(old)
+	c.Put(meme("new", 1))
+	if cached(c, "old") || !cached(c, "new") {
+		t.Error("want only the meme made within the TTL")
+	}
+	if _, ok := c.entries["old"]; ok || c.bytes != 1 {
+		t.Error("an expired meme was found but not removed")
+	}
+}
+
+func TestMemeCacheDiskTier(t *testing.T) {
+	config := cacheConfig{MaxEntries: 1, MaxBytes: 1 << 20, TTL: time.Hour, Dir: t.TempDir(), DiskMaxBytes: 1 << 20}
+	c := newMemeCache(config)
+	c.Put(meme("a", 3))
+	c.Put(meme("b", 3)) // a falls out of memory, but not off disk
+
+	got, ok := c.Get(context.Background(), "a")
+	if !ok || got.ContentType != "image/png" || len(got.Data) != 3 {
+		t.Fatalf("Get(a) = %+v, %v, want it read back from disk", got, ok)
+	}
+	if _, ok := c.entries["a"]; !ok {
+		t.Error("a meme read from disk wasn't put back in memory")
+	}
+
+	// A new cache on the same directory, as after a restart, still has them.
+	restarted := newMemeCache(config)
+	if !cached(restarted, "a") || !cached(restarted, "b") {
+		t.Error("the disk tier didn't survive a restart")
+	}
+
+	// Expired memes on disk are deleted when found.
+	config.TTL = time.Nanosecond
+	expiring := newMemeCache(config)
+	time.Sleep(time.Millisecond)
+	if cached(expiring, "a") {
+		t.Error("an expired meme was read from disk")
+	}
+	if _, err := os.Stat(config.Dir + "/a.json"); !os.IsNotExist(err) {
+		t.Errorf("the expired meme's metadata is still on disk: %v", err)
+	}
+}
+
+func TestMemeCachePrunesDisk(t *testing.T) {
+	dir := t.TempDir()
+	c := newMemeCache(cacheConfig{MaxEntries: 10, MaxBytes: 1 << 20, Dir: dir, DiskMaxBytes: 10})
+	for _, key := range []string{"a", "b", "c"} {
+		c.Put(meme(key, 4))
+		// Pruning goes by modification time, so keep them apart.
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := os.Stat(dir + "/a"); !os.IsNotExist(err) {
+		t.Error("the oldest meme is still on disk past DiskMaxBytes")
+	}
+	for _, key := range []string{"b", "c"} {
+		if _, err := os.Stat(dir + "/" + key); err != nil {
+			t.Errorf("%s was pruned: %v", key, err)
+		}
+	}
+}
+
+func TestETagMatches(t *testing.T) {
+	for _, tt := range []struct {
+		header string
+		want   bool
+	}{
+		{`"abc"`, true},
+		{`W/"abc"`, true},
+		{`"xyz", "abc"`, true},
+		{`*`, true},
+		{`"xyz"`, false},
+		{``, false},
+		{`abc`, false},
+	} {
+		if got := etagMatches(tt.header, `"abc"`); got != tt.want {
+			t.Errorf("etagMatches(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestCreatePictureAnswersNotModified(t *testing.T) {
+	// Pinning the phrase and the image means nothing downstream is called; with a matching
+	// ETag, meminator isn't either.
+	const body = `{"phrase":"test in prod","imageUrl":"https://random-pictures.s3.amazonaws.com/cat.png"}`
+	etag := `"` + cacheKey("test in prod", "https://random-pictures.s3.amazonaws.com/cat.png", nil, "") + `"`
+	r := httptest.NewRequest(http.MethodPost, "/createPicture", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("If-None-Match", etag)
+	w := httptest.NewRecorder()
+	createPicture(w, r)
+	if w.Code != http.StatusNotModified {
+		t.Fatalf("status = %d, want 304", w.Code)
+	}
+	if w.Header().Get("ETag") != etag || w.Body.Len() != 0 {
+		t.Errorf("ETag = %q with %d bytes of body, want %s and none", w.Header().Get("ETag"), w.Body.Len(), etag)
+	}
+}
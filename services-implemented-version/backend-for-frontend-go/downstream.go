@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/httptrace/otelhttptrace"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// downstream is a service the BFF calls. Each one keeps a single long-lived client,
+// so connections to it are pooled and reused across requests.
+type downstream struct {
+	name    string // reported as peer.service on client spans and metrics
+	url     string
+	timeout time.Duration
+	retry   retryPolicy
+	breaker *circuitBreaker
+	client  *http.Client
+}
+
+// transportConfig holds the connection settings shared by every downstream client.
+type transportConfig struct {
+	DialTimeout         time.Duration
+	TLSHandshakeTimeout time.Duration
+	// ResponseHeaderTimeout is zero unless set, leaving each client to wait for headers as long as
+	// its service's own timeout allows. meminator only answers once convert is done.
+	ResponseHeaderTimeout time.Duration
+	IdleConnTimeout       time.Duration
+	MaxIdleConns          int
+	MaxIdleConnsPerHost   int
+}
+
+// transportConfigFromEnv reads the HTTP_CLIENT_* environment variables, falling back to defaults.
+func transportConfigFromEnv() transportConfig {
+	return transportConfig{
+		DialTimeout:           envDuration("HTTP_CLIENT_DIAL_TIMEOUT", 2*time.Second),
+		TLSHandshakeTimeout:   envDuration("HTTP_CLIENT_TLS_HANDSHAKE_TIMEOUT", 2*time.Second),
+		ResponseHeaderTimeout: envDuration("HTTP_CLIENT_RESPONSE_HEADER_TIMEOUT", 0),
+		IdleConnTimeout:       envDuration("HTTP_CLIENT_IDLE_CONN_TIMEOUT", 90*time.Second),
+		MaxIdleConns:          envInt("HTTP_CLIENT_MAX_IDLE_CONNS", 100),
+		MaxIdleConnsPerHost:   envInt("HTTP_CLIENT_MAX_IDLE_CONNS_PER_HOST", 20),
+	}
+}
+
+func newDownstream(name, url string, timeout time.Duration, config transportConfig) *downstream {
+	headerTimeout := config.ResponseHeaderTimeout
+	if headerTimeout <= 0 {
+		headerTimeout = timeout
+	}
+	base := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   config.DialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   config.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: headerTimeout,
+		IdleConnTimeout:       config.IdleConnTimeout,
+		MaxIdleConns:          config.MaxIdleConns,
+		MaxIdleConnsPerHost:   config.MaxIdleConnsPerHost,
+	}
+
+	// otelhttp creates the client span and injects the propagation headers, once.
+	// The client trace adds child spans for DNS, connect and TLS, which makes connection reuse visible.
+	transport := otelhttp.NewTransport(base,
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return r.Method
+		}),
+		otelhttp.WithSpanOptions(trace.WithAttributes(semconv.PeerService(name))),
+		// http.client.duration and the size metrics, by service
+		otelhttp.WithMetricAttributesFn(func(*http.Request) []attribute.KeyValue {
+			return []attribute.KeyValue{semconv.PeerService(name)}
+		}),
+		otelhttp.WithClientTrace(func(ctx context.Context) *httptrace.ClientTrace {
+			return otelhttptrace.NewClientTrace(ctx)
+		}),
+	)
+
+	return &downstream{
+		name:    name,
+		url:     url,
+		timeout: timeout,
+		retry:   retryPolicyFromEnv(),
+		breaker: newCircuitBreaker(name, breakerConfigFromEnv()),
+		client:  &http.Client{Transport: transport},
+	}
+}
+
+type FetchOptions struct {
+	Method string
+	Body   interface{}
+	URL    string // overrides the service's URL
+	Query  url.Values
+}
+
+func fetchFromService(ctx context.Context, service *downstream, options *FetchOptions) (*http.Response, error) {
+	method := "GET"
+	target := service.url
+	if options != nil && options.URL != "" {
+		target = options.URL
+	}
+	if options != nil && len(options.Query) > 0 {
+		target += "?" + options.Query.Encode()
+	}
+	var body io.Reader
+	if options != nil && options.Body != nil {
+		payload, err := json.Marshal(options.Body)
+		if err != nil {
+			return nil, err
+		}
+		method = options.Method
+		body = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	ticket, err := service.breaker.allow(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var resp *http.Response
+	if method == http.MethodGet {
+		resp, err = doWithRetry(ctx, service, req)
+	} else {
+		resp, err = service.client.Do(req)
+	}
+	outcome := err
+	if err == nil && resp.StatusCode >= 500 {
+		outcome = fmt.Errorf("%s responded %s", service.name, resp.Status)
+	}
+	service.breaker.record(ctx, ticket, outcome)
+	return resp, err
+}
+
+// fetchJSON calls a downstream service in its own span, bounded by its timeout, and decodes the JSON body into result.
+func fetchJSON(ctx context.Context, spanName string, service *downstream, what string, query url.Values, result interface{}) error {
+	ctx, span := otel.Tracer("backend-for-frontend").Start(ctx, spanName)
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, service.timeout)
+	defer cancel()
+
+	fail := func(fe *fetchError) error {
+		span.RecordError(fe)
+		span.SetStatus(codes.Error, fe.Error())
+		return fe
+	}
+
+	response, err := fetchFromService(ctx, service, &FetchOptions{Query: query})
+	if err != nil {
+		return fail(transportError(service, "Failed to fetch "+what, err))
+	}
+	if response.StatusCode != http.StatusOK {
+		return fail(statusError(service, "Failed to fetch "+what, response))
+	}
+	defer response.Body.Close()
+	if err := json.NewDecoder(response.Body).Decode(result); err != nil {
+		return fail(&fetchError{
+			Title:          "Failed to decode " + what + " response",
+			Code:           codeDecodeFailed,
+			Dependency:     service.name,
+			UpstreamStatus: response.StatusCode,
+			err:            err,
+		})
+	}
+	return nil
+}
+
+func envDuration(name string, fallback time.Duration) time.Duration {
+	if value, err := time.ParseDuration(os.Getenv(name)); err == nil {
+		return value
+	}
+	return fallback
+}
+
+func envInt(name string, fallback int) int {
+	if value, err := strconv.Atoi(os.Getenv(name)); err == nil {
+		return value
+	}
+	return fallback
+}
+
+func envBool(name string, fallback bool) bool {
+	if value, err := strconv.ParseBool(os.Getenv(name)); err == nil {
+		return value
+	}
+	return fallback
+}
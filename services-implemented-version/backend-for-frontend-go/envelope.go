@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// memeEnvelope is the JSON form of /createPicture: the meme plus everything that went into it.
+// Image is base64 in JSON. It is left out when the client asks for ?inline=false and the
+// meme has a permalink to fetch it from instead.
+type memeEnvelope struct {
+	ID          string     `json:"id,omitempty"`
+	Permalink   string     `json:"permalink,omitempty"`
+	ContentType string     `json:"contentType"`
+	Size        int        `json:"size"`
+	Image       []byte     `json:"image,omitempty"`
+	Phrase      string     `json:"phrase"`
+	ImageURL    string     `json:"imageUrl"`
+	Style       *memeStyle `json:"style,omitempty"`
+	Seed        int64      `json:"seed"`
+	RenderMs    int64      `json:"renderMs"`
+	TraceID     string     `json:"traceId"`
+	Degraded    []string   `json:"degraded,omitempty"`
+}
+
+func newMemeEnvelope(ctx context.Context, r *http.Request, id string, saved bool, inputs *memeInputs, meme *cachedMeme, renderTime time.Duration) memeEnvelope {
+	envelope := memeEnvelope{
+		ContentType: meme.ContentType,
+		Size:        len(meme.Data),
+		Image:       meme.Data,
+		Phrase:      inputs.Phrase,
+		ImageURL:    inputs.ImageURL,
+		Style:       inputs.Style,
+		Seed:        inputs.Seed,
+		RenderMs:    renderTime.Milliseconds(),
+		TraceID:     trace.SpanContextFromContext(ctx).TraceID().String(),
+		Degraded:    inputs.degraded.list(),
+	}
+	if saved {
+		envelope.ID = id
+		envelope.Permalink = permalink(r, id)
+		if r.URL.Query().Get("inline") == "false" {
+			envelope.Image = nil
+		}
+	}
+	return envelope
+}
+
+func writeMemeEnvelope(ctx context.Context, w http.ResponseWriter, envelope memeEnvelope) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(envelope); err != nil {
+		trace.SpanFromContext(ctx).RecordError(err)
+	}
+}
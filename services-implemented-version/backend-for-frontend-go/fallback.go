@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// fallbackConfig chooses which dependency failures are covered up with a degraded meme
+// instead of failing the whole request.
+type fallbackConfig struct {
+	Phrase   bool   // use a built-in phrase when phrase-picker fails
+	Image    bool   // use the bundled image when image-picker fails
+	Picture  bool   // return the unannotated image when meminator fails
+	ImageURL string // where meminator can download the bundled image from
+}
+
+// fallbackConfigFromEnv reads the FALLBACK_* environment variables. All fallbacks are on by default.
+func fallbackConfigFromEnv() fallbackConfig {
+	imageURL := os.Getenv("FALLBACK_IMAGE_URL")
+	if imageURL == "" {
+		imageURL = fmt.Sprintf("http://backend-for-frontend:%d/fallback.png", port)
+	}
+	return fallbackConfig{
+		Phrase:   envBool("FALLBACK_PHRASE", true),
+		Image:    envBool("FALLBACK_IMAGE", true),
+		Picture:  envBool("FALLBACK_PICTURE", true),
+		ImageURL: imageURL,
+	}
+}
+
+var fallbacks = fallbackConfigFromEnv()
+
+// fallbackPhrases is used when phrase-picker can't be reached.
+var fallbackPhrases = []string{
+	"this is fine",
+	"degraded, not defeated",
+	"graceful degradation",
+	"it works on my machine",
+	"have you tried restarting?",
+}
+
+//go:embed fallback.png
+var fallbackImage []byte
+
+// fallbackPhrase picks a built-in phrase. The same seed picks the same one, as it would from
+// phrase-picker.
+func fallbackPhrase(seed int64) string {
+	return fallbackPhrases[rand.New(rand.NewSource(seed)).Intn(len(fallbackPhrases))]
+}
+
+// degradable reports whether a failed call may be covered up with a fallback: it failed on the
+// way or on the other side, and not because of what the client asked for.
+func degradable(ctx context.Context, err error) bool {
+	var re *requestError
+	return err != nil && !errors.As(err, &re) && ctx.Err() == nil
+}
+
+// serveFallbackImage serves the bundled image, so meminator can download it like any other.
+func serveFallbackImage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(fallbackImage)
+}
+
+// degradation records which parts of a meme were substituted during one request.
+// It is safe to use from the concurrent fetches.
+type degradation struct {
+	mu    sync.Mutex
+	parts []string
+}
+
+func (d *degradation) add(ctx context.Context, part string, cause error) {
+	d.mu.Lock()
+	d.parts = append(d.parts, part)
+	d.mu.Unlock()
+	trace.SpanFromContext(ctx).AddEvent("fallback", trace.WithAttributes(
+		attribute.String("app.degraded", part),
+		attribute.String("error.message", cause.Error()),
+	))
+}
+
+// list returns the substituted parts, or nil if the meme is complete.
+func (d *degradation) list() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.parts) == 0 {
+		return nil
+	}
+	return append([]string(nil), d.parts...)
+}
+
+func (d *degradation) String() string {
+	return strings.Join(d.list(), ",")
+}
+
+// apply marks the response and the span as degraded. Call it before writing the body.
+func (d *degradation) apply(w http.ResponseWriter, span trace.Span) {
+	value := d.String()
+	if value == "" {
+		return
+	}
+	w.Header().Set("X-Degraded", value)
+	span.SetAttributes(attribute.String("app.degraded", value))
+}
+
+// maxSourceImageBytes caps how much of a source image the BFF reads when it serves one itself.
+const maxSourceImageBytes = 20 << 20
+
+// onlyImageHosts stops service from following redirects off the allowed image hosts.
+func onlyImageHosts(service *downstream) *downstream {
+	service.client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 10 || !allowedImageURL(req.URL.String()) {
+			return http.ErrUseLastResponse
+		}
+		return nil
+	}
+	return service
+}
+
+// fetchSourceImage gets the image meminator would have annotated, without the phrase.
+// It only fetches from the allowed image hosts, and only passes on images.
+// The result has no cache key, so it is never cached.
+func fetchSourceImage(ctx context.Context, imageURL string) (*cachedMeme, error) {
+	if imageURL == fallbacks.ImageURL {
+		return &cachedMeme{ContentType: "image/png", Created: time.Now(), Data: fallbackImage}, nil
+	}
+	if !allowedImageURL(imageURL) {
+		return nil, &requestError{errors.New("imageUrl is not on one of the allowed image hosts")}
+	}
+
+	response, err := fetchFromService(ctx, imageSource, &FetchOptions{URL: imageURL})
+	if err != nil {
+		return nil, transportError(imageSource, "Failed to fetch source image", err)
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, statusError(imageSource, "Failed to fetch source image", response)
+	}
+	defer response.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(response.Body, maxSourceImageBytes+1))
+	if err != nil {
+		return nil, transportError(imageSource, "Failed to read source image", err)
+	}
+	notImage := func(reason string) error {
+		return &fetchError{
+			Title:          "Source is not an image",
+			Code:           codeBadStatus,
+			Dependency:     imageSource.name,
+			UpstreamStatus: response.StatusCode,
+			err:            errors.New(reason),
+		}
+	}
+	if len(data) > maxSourceImageBytes {
+		return nil, notImage(fmt.Sprintf("larger than %d bytes", maxSourceImageBytes))
+	}
+	// Trust neither the header nor the bytes alone.
+	contentType := response.Header.Get("Content-Type")
+	if !strings.HasPrefix(contentType, "image/") || !strings.HasPrefix(http.DetectContentType(data), "image/") {
+		return nil, notImage(fmt.Sprintf("content type %q", contentType))
+	}
+	return &cachedMeme{ContentType: contentType, Created: time.Now(), Data: data}, nil
+}
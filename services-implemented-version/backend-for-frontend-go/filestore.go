@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// fileStore keeps the gallery in a local directory, as a data file plus a .json metadata file per meme.
+// It reads the directory once, at start, and keeps the sorted IDs in memory to page through.
+type fileStore struct {
+	dir      string
+	maxMemes int
+
+	mu  sync.Mutex
+	ids []string // sorted, so newest first
+}
+
+func newFileStore(dir string, maxMemes int) (*fileStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating gallery directory: %w", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading gallery directory: %w", err)
+	}
+	s := &fileStore{dir: dir, maxMemes: maxMemes}
+	for _, entry := range entries {
+		if id, ok := strings.CutSuffix(entry.Name(), ".json"); ok && memeIDPattern.MatchString(id) {
+			s.ids = append(s.ids, id)
+		}
+	}
+	sort.Strings(s.ids)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.trim()
+	return s, nil
+}
+
+func (s *fileStore) paths(id string) (string, string) {
+	data := filepath.Join(s.dir, id)
+	return data, data + ".json"
+}
+
+func (s *fileStore) Save(ctx context.Context, record memeRecord, data []byte) error {
+	if !memeIDPattern.MatchString(record.ID) {
+		return fmt.Errorf("invalid meme ID %q", record.ID)
+	}
+	dataPath, metaPath := s.paths(record.ID)
+	meta, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(dataPath, data, 0o644); err != nil {
+		return err
+	}
+	// The metadata goes last: a meme without it is never listed.
+	if err := os.WriteFile(metaPath, meta, 0o644); err != nil {
+		os.Remove(dataPath)
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := sort.SearchStrings(s.ids, record.ID)
+	if i == len(s.ids) || s.ids[i] != record.ID {
+		s.ids = append(s.ids, "")
+		copy(s.ids[i+1:], s.ids[i:])
+		s.ids[i] = record.ID
+	}
+	s.trim()
+	return nil
+}
+
+// trim removes the oldest memes beyond maxMemes. s.mu must be held.
+func (s *fileStore) trim() {
+	if s.maxMemes <= 0 {
+		return
+	}
+	for len(s.ids) > s.maxMemes {
+		id := s.ids[len(s.ids)-1]
+		s.ids = s.ids[:len(s.ids)-1]
+		dataPath, metaPath := s.paths(id)
+		// The metadata goes first, so a half-removed meme is never listed.
+		os.Remove(metaPath)
+		os.Remove(dataPath)
+	}
+}
+
+func (s *fileStore) Load(ctx context.Context, id string) (memeRecord, []byte, error) {
+	var record memeRecord
+	if !memeIDPattern.MatchString(id) {
+		return record, nil, errMemeNotFound
+	}
+	record, err := s.loadRecord(id)
+	if err != nil {
+		return record, nil, err
+	}
+	dataPath, _ := s.paths(id)
+	data, err := os.ReadFile(dataPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return record, nil, errMemeNotFound
+	}
+	return record, data, err
+}
+
+func (s *fileStore) LoadRecord(ctx context.Context, id string) (memeRecord, error) {
+	if !memeIDPattern.MatchString(id) {
+		return memeRecord{}, errMemeNotFound
+	}
+	return s.loadRecord(id)
+}
+
+func (s *fileStore) loadRecord(id string) (memeRecord, error) {
+	var record memeRecord
+	_, metaPath := s.paths(id)
+	meta, err := os.ReadFile(metaPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return record, errMemeNotFound
+	}
+	if err != nil {
+		return record, err
+	}
+	return record, json.Unmarshal(meta, &record)
+}
+
+func (s *fileStore) List(ctx context.Context, after string, limit int) ([]memeRecord, error) {
+	// Holding the lock keeps trim from removing memes while they are read.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := sort.SearchStrings(s.ids, after)
+	if i < len(s.ids) && s.ids[i] == after {
+		i++
+	}
+	records := []memeRecord{}
+	for _, id := range s.ids[i:] {
+		if len(records) == limit {
+			break
+		}
+		record, err := s.loadRecord(id)
+		if err != nil {
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// imageFormats are the formats meminator can encode a meme to, with their content types.
+var imageFormats = map[string]string{
+	"png":  "image/png",
+	"jpeg": "image/jpeg",
+	"webp": "image/webp",
+	"gif":  "image/gif",
+}
+
+var errNotAcceptable = &apiError{
+	Status: http.StatusNotAcceptable,
+	Code:   "not_acceptable",
+	Title:  "Memes can only be sent as image/png, image/jpeg, image/webp, image/gif or application/json",
+}
+
+// formatOf is the name in imageFormats of a content type, or empty if it isn't one of them.
+func formatOf(contentType string) string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	for format, formatType := range imageFormats {
+		if formatType == mediaType {
+			return format
+		}
+	}
+	return ""
+}
+
+// jsonFormat asks for the meme wrapped in a JSON envelope with its metadata, instead of the bare image.
+const jsonFormat = "json"
+
+// normalizeFormat accepts the common spelling "jpg" as well as "jpeg".
+func normalizeFormat(format string) string {
+	format = strings.ToLower(format)
+	if format == "jpg" {
+		return "jpeg"
+	}
+	return format
+}
+
+// negotiateFormat settles what /createPicture sends back. ?format=json, or an Accept header that
+// prefers application/json, asks for the JSON envelope. The image format is the body's if there
+// is one, then ?format=, then the client's favourite image type in Accept. Leaving it empty
+// keeps whatever format the source image was in.
+func negotiateFormat(r *http.Request, request *createPictureRequest) (envelope bool, err error) {
+	span := trace.SpanFromContext(r.Context())
+	defer func() {
+		span.SetAttributes(
+			attribute.String("app.format", request.Format),
+			attribute.Bool("app.envelope", envelope),
+		)
+	}()
+
+	format := normalizeFormat(r.URL.Query().Get("format"))
+	if format == "" {
+		accepted, ok := acceptedFormat(r.Header.Get("Accept"))
+		switch {
+		case accepted == jsonFormat:
+			format = jsonFormat
+		case request.Format != "":
+			return false, nil
+		case !ok:
+			return false, errNotAcceptable
+		default:
+			format = accepted
+		}
+	}
+	if format == jsonFormat {
+		return true, nil
+	}
+	if request.Format != "" {
+		return false, nil
+	}
+	if _, ok := imageFormats[format]; format != "" && !ok {
+		return false, &requestError{errors.New("format must be json, png, jpeg, webp or gif")}
+	}
+	request.Format = format
+	return false, nil
+}
+
+// acceptedFormat picks the image format, or jsonFormat, with the highest q-value in an Accept header.
+// A wildcard that beats every concrete type means any format will do. Among equals, earlier entries win.
+func acceptedFormat(accept string) (string, bool) {
+	if strings.TrimSpace(accept) == "" {
+		return "", true
+	}
+	best, bestQ, found := "", 0.0, false
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if value, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(value, 64); err != nil {
+				continue
+			}
+		}
+		if q <= 0 || (found && q <= bestQ) {
+			continue
+		}
+		switch {
+		case mediaType == "*/*" || mediaType == "image/*":
+			best, bestQ, found = "", q, true
+		case mediaType == "application/json":
+			best, bestQ, found = jsonFormat, q, true
+		default:
+			for format, contentType := range imageFormats {
+				if contentType == mediaType {
+					best, bestQ, found = format, q, true
+				}
+			}
+		}
+	}
+	return best, found
+}
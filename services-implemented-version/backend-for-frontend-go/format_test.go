@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAcceptedFormat(t *testing.T) {
+	for _, tt := range []struct {
+		accept string
+		want   string
+		ok     bool
+	}{
+		{"", "", true},
+		{"image/png", "png", true},
+		{"IMAGE/PNG", "png", true},
+		{"image/png, image/jpeg", "png", true}, // among equals, the first
+		{"image/png;q=0.5, image/webp", "webp", true},
+		{"image/webp;q=0.9, image/png;q=0.5", "webp", true},
+		{"image/*", "", true},
+		{"*/*;q=0.1, image/gif", "gif", true},
+		{"image/gif;q=0.5, */*", "", true}, // any format beats gif
+		{"text/html, application/json;q=0.9", jsonFormat, true},
+		{"application/json;q=0.5, image/png", "png", true},
+		{"image/png;q=abc, image/jpeg", "jpeg", true},
+		{"text/html", "", false},
+		{"image/png;q=0", "", false},
+		{"image/bmp, text/plain", "", false},
+	} {
+		got, ok := acceptedFormat(tt.accept)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("acceptedFormat(%q) = %q, %v, want %q, %v", tt.accept, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestNegotiateFormat(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		query      string
+		accept     string
+		bodyFormat string
+		format     string
+		envelope   bool
+		err        error
+	}{
+		{"nothing asked keeps the source format", "", "", "", "", false, nil},
+		{"query", "?format=png", "", "", "png", false, nil},
+		{"query jpg", "?format=jpg", "", "", "jpeg", false, nil},
+		{"query json", "?format=json", "image/png", "", "", true, nil},
+		{"query beats Accept", "?format=gif", "text/html", "", "gif", false, nil},
+		{"Accept", "", "image/webp", "", "webp", false, nil},
+		{"Accept json", "", "application/json", "", "", true, nil},
+		{"body beats query and Accept", "?format=png", "image/gif", "webp", "webp", false, nil},
+		{"body with json Accept", "", "application/json", "webp", "webp", true, nil},
+		{"body with an Accept it can't meet", "", "text/html", "png", "png", false, nil},
+		{"unknown query format", "?format=bmp", "", "", "", false, &requestError{}},
+		{"nothing acceptable", "", "text/html", "", "", false, errNotAcceptable},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/createPicture"+tt.query, nil)
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			request := createPictureRequest{Format: tt.bodyFormat}
+			envelope, err := negotiateFormat(r, &request)
+			switch want := tt.err.(type) {
+			case nil:
+				if err != nil {
+					t.Fatalf("err = %v", err)
+				}
+			case *requestError:
+				if !errors.As(err, &want) {
+					t.Fatalf("err = %v, want a requestError", err)
+				}
+				return
+			default:
+				if err != tt.err {
+					t.Fatalf("err = %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if request.Format != tt.format || envelope != tt.envelope {
+				t.Errorf("got %q envelope=%v, want %q envelope=%v", request.Format, envelope, tt.format, tt.envelope)
+			}
+		})
+	}
+}
+
+func TestCreatePictureVariesOnAccept(t *testing.T) {
+	// Refused before any downstream is called, but caches still need to know why.
+	r := httptest.NewRequest(http.MethodPost, "/createPicture", nil)
+	r.Header.Set("Accept", "text/html")
+	w := httptest.NewRecorder()
+	createPicture(w, r)
+	if w.Code != http.StatusNotAcceptable {
+		t.Fatalf("status = %d, want 406", w.Code)
+	}
+	if got := w.Header().Get("Vary"); got != "Accept" {
+		t.Errorf("Vary = %q, want Accept", got)
+	}
+	if got := w.Header().Get("Content-Type"); got != "application/problem+json" {
+		t.Errorf("Content-Type = %q, want a problem document", got)
+	}
+}
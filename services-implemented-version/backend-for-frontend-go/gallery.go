@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// memeRecord is what the gallery keeps about a meme, next to the picture itself.
+type memeRecord struct {
+	ID          string     `json:"id"`
+	Phrase      string     `json:"phrase"`
+	ImageURL    string     `json:"imageUrl"`
+	Style       *memeStyle `json:"style,omitempty"`
+	Seed        int64      `json:"seed"`
+	TraceID     string     `json:"traceId"`
+	SpanID      string     `json:"spanId,omitempty"`
+	ParentID    string     `json:"parent_id,omitempty"` // the meme this one is a remix of
+	Timestamp   time.Time  `json:"timestamp"`
+	Format      string     `json:"format,omitempty"` // as asked for; empty kept the source image's
+	ContentType string     `json:"contentType"`
+	Size        int        `json:"size"`
+	Degraded    []string   `json:"degraded,omitempty"`
+}
+
+// memeStore keeps memes for good. Implementations list memes in ID order, which newMemeID
+// makes newest first, and return errMemeNotFound for IDs they don't have.
+type memeStore interface {
+	Save(ctx context.Context, record memeRecord, data []byte) error
+	Load(ctx context.Context, id string) (memeRecord, []byte, error)
+	// LoadRecord returns a meme's metadata without reading the picture.
+	LoadRecord(ctx context.Context, id string) (memeRecord, error)
+	// List returns up to limit memes with IDs after the given one, or from the start if after is empty.
+	List(ctx context.Context, after string, limit int) ([]memeRecord, error)
+}
+
+// memeIDPattern is what newMemeID makes. Stores check IDs from the URL against it, so that they
+// can't name files outside a directory, or other objects in a bucket.
+var memeIDPattern = regexp.MustCompile(`^[0-9a-f]{1,64}$`)
+
+var errMemeNotFound = &apiError{Status: http.StatusNotFound, Code: "not_found", Title: "No such meme"}
+
+// storageConfig picks where the gallery lives. Backend is "file", "s3" or "none".
+type storageConfig struct {
+	Backend  string
+	Dir      string
+	MaxMemes int // how many memes the file backend keeps, dropping the oldest; 0 keeps them all
+	S3       s3Config
+}
+
+// storageConfigFromEnv reads the STORAGE_* and S3_* environment variables, falling back to defaults.
+func storageConfigFromEnv() storageConfig {
+	config := storageConfig{
+		Backend:  os.Getenv("STORAGE_BACKEND"),
+		Dir:      os.Getenv("STORAGE_DIR"),
+		MaxMemes: envInt("STORAGE_MAX_MEMES", 1000),
+		S3:       s3ConfigFromEnv(),
+	}
+	// Keeping every meme is something to ask for, not something to find out about.
+	if config.Backend == "" {
+		config.Backend = "none"
+	}
+	if config.Dir == "" {
+		config.Dir = filepath.Join(os.TempDir(), "memes")
+	}
+	return config
+}
+
+// openMemeStore connects to the configured backend. It returns nil when the gallery is turned off.
+func openMemeStore(ctx context.Context, config storageConfig) (memeStore, error) {
+	switch config.Backend {
+	case "none":
+		return nil, nil
+	case "file":
+		return newFileStore(config.Dir, config.MaxMemes)
+	case "s3":
+		return newS3Store(ctx, config.S3)
+	default:
+		return nil, fmt.Errorf("unknown STORAGE_BACKEND %q", config.Backend)
+	}
+}
+
+// gallery is set up by main. Without it, memes are not kept.
+var gallery memeStore
+
+// newMemeID makes an ID that sorts before every ID made earlier, so listing in key order
+// shows the newest memes first. It is also the ID of the job that made the meme.
+func newMemeID() string {
+	random := make([]byte, 4)
+	rand.Read(random)
+	return fmt.Sprintf("%016x%s", math.MaxInt64-time.Now().UnixNano(), hex.EncodeToString(random))
+}
+
+// saveMeme adds a meme to the gallery. Failing to save doesn't fail the request: the meme
+// has already been made, it just won't have a permalink.
+func saveMeme(ctx context.Context, id string, inputs *memeInputs, meme *cachedMeme) bool {
+	return storeMeme(ctx, newMemeRecord(ctx, id, inputs), meme)
+}
+
+// newMemeRecord describes a meme made in the span in ctx, so the gallery can lead back to its trace.
+func newMemeRecord(ctx context.Context, id string, inputs *memeInputs) memeRecord {
+	spanContext := trace.SpanContextFromContext(ctx)
+	return memeRecord{
+		ID:        id,
+		Phrase:    inputs.Phrase,
+		ImageURL:  inputs.ImageURL,
+		Style:     inputs.Style,
+		Seed:      inputs.Seed,
+		Format:    inputs.Format,
+		TraceID:   spanContext.TraceID().String(),
+		SpanID:    spanContext.SpanID().String(),
+		Timestamp: time.Now().UTC(),
+		Degraded:  inputs.degraded.list(),
+	}
+}
+
+// storeMeme saves a meme under a record the caller has filled in, in a span of its own.
+func storeMeme(ctx context.Context, record memeRecord, meme *cachedMeme) bool {
+	if gallery == nil {
+		return false
+	}
+	ctx, span := otel.Tracer("backend-for-frontend").Start(ctx, "saveMeme",
+		trace.WithAttributes(attribute.String("app.meme.id", record.ID)))
+	defer span.End()
+
+	record.ContentType = meme.ContentType
+	record.Size = len(meme.Data)
+	if err := gallery.Save(ctx, record, meme.Data); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return false
+	}
+	return true
+}
+
+// permalink is where a saved meme can always be found.
+func permalink(r *http.Request, id string) string {
+	return publicPath(r, "/m/"+id)
+}
+
+type galleryItem struct {
+	memeRecord
+	URL string `json:"url"`
+}
+
+type galleryPage struct {
+	Items []galleryItem `json:"items"`
+	Next  string        `json:"next,omitempty"`
+}
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+var errGalleryDisabled = &apiError{Status: http.StatusServiceUnavailable, Code: "gallery_disabled", Title: "Memes are not being kept"}
+
+// listMemes handles GET /memes. It pages through the gallery with ?limit= and ?after=,
+// and links to the next page while there is one.
+func listMemes(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if gallery == nil {
+		writeProblem(ctx, w, r, errGalleryDisabled)
+		return
+	}
+	limit := defaultPageSize
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxPageSize {
+			writeProblem(ctx, w, r, &requestError{fmt.Errorf("limit must be between 1 and %d", maxPageSize)})
+			return
+		}
+		limit = n
+	}
+	after := r.URL.Query().Get("after")
+
+	// Ask for one more than the page holds to find out whether there is a next page.
+	records, err := gallery.List(ctx, after, limit+1)
+	if err != nil {
+		writeProblem(ctx, w, r, err)
+		return
+	}
+	page := galleryPage{Items: []galleryItem{}}
+	if len(records) > limit {
+		records = records[:limit]
+		next := url.Values{"limit": {strconv.Itoa(limit)}, "after": {records[limit-1].ID}}
+		page.Next = publicPath(r, "/memes?"+next.Encode())
+	}
+	for _, record := range records {
+		page.Items = append(page.Items, galleryItem{record, permalink(r, record.ID)})
+	}
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int("app.gallery.page_size", len(page.Items)))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+// getPermalink handles GET /m/{id}. A meme never changes once saved, so it can be cached for good.
+func getPermalink(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if gallery == nil {
+		writeProblem(ctx, w, r, errGalleryDisabled)
+		return
+	}
+	id := r.PathValue("id")
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("app.meme.id", id))
+	etag := `"` + id + `"`
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.Header().Set("ETag", etag)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	record, data, err := gallery.Load(ctx, id)
+	if err != nil {
+		writeProblem(ctx, w, r, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Content-Type", record.ContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
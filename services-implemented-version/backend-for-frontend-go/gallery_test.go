@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// saveMemes saves n small memes, oldest first, and returns their IDs newest first.
+func saveMemes(t *testing.T, store memeStore, n int) []string {
+	t.Helper()
+	ids := make([]string, n)
+	for i := 0; i < n; i++ {
+		record := memeRecord{
+			ID:          newMemeID(),
+			Phrase:      fmt.Sprintf("phrase %d", i),
+			ImageURL:    "http://example.com/cat.png",
+			Seed:        int64(i),
+			Timestamp:   time.Now().UTC(),
+			ContentType: "image/png",
+			Size:        1,
+		}
+		if err := store.Save(context.Background(), record, []byte{byte(i)}); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+		ids[n-1-i] = record.ID
+	}
+	return ids
+}
+
+// testMemeStore checks what the gallery expects of every memeStore.
+func testMemeStore(t *testing.T, store memeStore) {
+	ctx := context.Background()
+	ids := saveMemes(t, store, 5)
+
+	record, data, err := store.Load(ctx, ids[4])
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if record.Phrase != "phrase 0" || record.Seed != 0 || !bytes.Equal(data, []byte{0}) {
+		t.Errorf("Load = %+v, %v, want the first meme saved", record, data)
+	}
+	for _, id := range []string{"0123abcd", "../" + ids[0], "meta/" + ids[0], ids[0] + ".json", ""} {
+		if _, _, err := store.Load(ctx, id); !errors.Is(err, errMemeNotFound) {
+			t.Errorf("Load(%q) = %v, want errMemeNotFound", id, err)
+		}
+		if _, err := store.LoadRecord(ctx, id); !errors.Is(err, errMemeNotFound) {
+			t.Errorf("LoadRecord(%q) = %v, want errMemeNotFound", id, err)
+		}
+	}
+	if err := store.Save(ctx, memeRecord{ID: "../escape"}, []byte{0}); err == nil {
+		t.Error("saved a meme under an ID that isn't one")
+	}
+
+	// Two pages of two, newest first, then the last one.
+	var listed []string
+	after := ""
+	for page := 0; page < 4; page++ {
+		records, err := store.List(ctx, after, 2)
+		if err != nil {
+			t.Fatalf("List: %v", err)
+		}
+		if len(records) == 0 {
+			break
+		}
+		for _, record := range records {
+			listed = append(listed, record.ID)
+		}
+		after = records[len(records)-1].ID
+	}
+	if fmt.Sprint(listed) != fmt.Sprint(ids) {
+		t.Errorf("listed %v, want %v", listed, ids)
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	store, err := newFileStore(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testMemeStore(t, store)
+}
+
+func TestFileStoreKeepsNewestMemes(t *testing.T) {
+	dir := t.TempDir()
+	store, err := newFileStore(dir, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := saveMemes(t, store, 5)
+
+	records, err := store.List(context.Background(), "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 || records[0].ID != ids[0] || records[2].ID != ids[2] {
+		t.Errorf("listed %d memes, want the newest 3", len(records))
+	}
+	if _, _, err := store.Load(context.Background(), ids[4]); !errors.Is(err, errMemeNotFound) {
+		t.Errorf("Load of the oldest meme = %v, want it removed", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 6 {
+		t.Errorf("%d files in the gallery, want 2 for each of 3 memes", len(entries))
+	}
+
+	// A store opened later on the same directory finds the memes that are left.
+	reopened, err := newFileStore(dir, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reopened.ids) != 3 || reopened.ids[0] != ids[0] {
+		t.Errorf("reopened with %v, want %v", reopened.ids, ids[:3])
+	}
+}
+
+// TestS3Store runs against the S3-compatible store at S3_ENDPOINT, such as the minio service
+// in docker-compose.yaml, in a bucket of its own that it removes afterwards.
+func TestS3Store(t *testing.T) {
+	config := s3ConfigFromEnv()
+	if config.Endpoint == "" {
+		t.Skip("S3_ENDPOINT is not set")
+	}
+	config.Bucket = fmt.Sprintf("memes-test-%d", time.Now().UnixNano())
+	ctx := context.Background()
+	store, err := newS3Store(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		for object := range store.client.ListObjects(ctx, store.bucket, minio.ListObjectsOptions{Recursive: true}) {
+			store.client.RemoveObject(ctx, store.bucket, object.Key, minio.RemoveObjectOptions{})
+		}
+		if err := store.client.RemoveBucket(ctx, store.bucket); err != nil {
+			t.Logf("removing bucket %s: %v", store.bucket, err)
+		}
+	})
+	testMemeStore(t, store)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	idempotencyHeader = "Idempotency-Key"
+	replayedHeader    = "Idempotent-Replayed"
+	maxIdempotencyKey = 255
+)
+
+var (
+	errIdempotencyKeyReused = &apiError{Status: http.StatusUnprocessableEntity, Code: "idempotency_key_reused", Title: "This Idempotency-Key was already used with a different request"}
+	errIdempotencyKeyLength = &apiError{Status: http.StatusBadRequest, Code: codeInvalid, Title: "Idempotency-Key must be between 1 and 255 characters"}
+)
+
+// idempotencyConfig bounds the responses kept for retries. Responses are pictures, so they are
+// kept only long enough to cover a client's retries, and the oldest go first when either limit is hit.
+type idempotencyConfig struct {
+	TTL        time.Duration
+	MaxEntries int
+	MaxBytes   int64
+}
+
+// idempotencyConfigFromEnv reads the IDEMPOTENCY_* environment variables, falling back to defaults.
+func idempotencyConfigFromEnv() idempotencyConfig {
+	return idempotencyConfig{
+		TTL:        envDuration("IDEMPOTENCY_TTL", 10*time.Minute),
+		MaxEntries: envInt("IDEMPOTENCY_MAX_ENTRIES", 1000),
+		MaxBytes:   int64(envInt("IDEMPOTENCY_MAX_BYTES", 32<<20)),
+	}
+}
+
+// idempotentResponse is a response kept to answer retries with. done is closed once it is complete.
+type idempotentResponse struct {
+	key         string
+	fingerprint string
+	done        chan struct{}
+	expires     time.Time
+
+	status int
+	header http.Header
+	body   []byte
+	size   int64 // counted against MaxBytes once kept
+}
+
+// idempotencyCache remembers responses to POST requests that carried an Idempotency-Key, so a
+// client retrying after a timeout gets the first result instead of a second meme.
+type idempotencyCache struct {
+	config idempotencyConfig
+
+	mu        sync.Mutex
+	responses map[string]*list.Element
+	order     *list.List // oldest first
+	bytes     int64
+}
+
+func newIdempotencyCache(config idempotencyConfig) *idempotencyCache {
+	return &idempotencyCache{config: config, responses: map[string]*list.Element{}, order: list.New()}
+}
+
+var idempotency = newIdempotencyCache(idempotencyConfigFromEnv())
+
+// start sweeps out expired responses every so often, until ctx is done.
+func (c *idempotencyCache) start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(max(c.config.TTL/2, time.Second))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				c.mu.Lock()
+				// Responses are in the order they started, so the expired ones are at the front.
+				for e := c.order.Front(); e != nil && now.After(e.Value.(*idempotentResponse).expires); e = c.order.Front() {
+					c.remove(e)
+				}
+				c.mu.Unlock()
+			}
+		}
+	}()
+}
+
+// begin finds the response for key, or starts one if there isn't one yet. started says which.
+func (c *idempotencyCache) begin(key, fingerprint string) (response *idempotentResponse, started bool) {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.responses[key]; ok {
+		response = e.Value.(*idempotentResponse)
+		if now.Before(response.expires) {
+			return response, false
+		}
+		c.remove(e)
+	}
+	for c.order.Len() > 0 && c.order.Len() >= c.config.MaxEntries {
+		c.remove(c.order.Front())
+	}
+	response = &idempotentResponse{key: key, fingerprint: fingerprint, done: make(chan struct{}), expires: now.Add(c.config.TTL)}
+	c.responses[key] = c.order.PushBack(response)
+	return response, true
+}
+
+// finish completes a response, keeping it for replays if keep is set and it fits.
+func (c *idempotencyCache) finish(response *idempotentResponse, status int, header http.Header, body []byte, keep bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	response.status, response.header, response.body = status, header, body
+	close(response.done)
+	e, ok := c.responses[response.key]
+	if !ok || e.Value != response {
+		return
+	}
+	if !keep || int64(len(body)) > c.config.MaxBytes {
+		c.remove(e)
+		return
+	}
+	response.size = int64(len(body))
+	c.bytes += response.size
+	for c.bytes > c.config.MaxBytes {
+		c.remove(c.order.Front())
+	}
+}
+
+// remove forgets a response. It must be called with mu held. Retries already waiting on it still
+// get it; the next one runs the request again.
+func (c *idempotencyCache) remove(e *list.Element) {
+	response := c.order.Remove(e).(*idempotentResponse)
+	delete(c.responses, response.key)
+	c.bytes -= response.size
+}
+
+// recordingWriter passes a response through while keeping a copy of it.
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *recordingWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+// middleware replays the stored response for a repeated Idempotency-Key, waiting for it if the
+// first request is still running. Keys are scoped to the caller and the endpoint. A retry has to
+// be the same request, down to the Accept header that picks the response's format, or it is
+// refused. Failures that are worth retrying, 429 and 5xx, are not kept.
+func (c *idempotencyCache) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyHeader)
+		if r.Method != http.MethodPost || key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx := r.Context()
+		span := trace.SpanFromContext(ctx)
+		if len(key) > maxIdempotencyKey {
+			writeProblem(ctx, w, r, errIdempotencyKeyLength)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			writeProblem(ctx, w, r, &requestError{err})
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		client, _ := limiter.clientKey(r)
+		scope := client + " " + r.URL.Path + " " + key
+		sum := sha256.Sum256(append([]byte(r.URL.RawQuery+"\n"+r.Header.Get("Accept")+"\n"), body...))
+		fingerprint := hex.EncodeToString(sum[:])
+
+		for {
+			response, started := c.begin(scope, fingerprint)
+			if started {
+				span.SetAttributes(attribute.String("app.idempotency.result", "miss"))
+				recorder := &recordingWriter{ResponseWriter: w}
+				defer func() {
+					keep := recorder.status != 0 && recorder.status != http.StatusTooManyRequests && recorder.status < 500
+					c.finish(response, recorder.status, w.Header().Clone(), recorder.body.Bytes(), keep)
+				}()
+				next.ServeHTTP(recorder, r)
+				return
+			}
+
+			if response.fingerprint != fingerprint {
+				span.SetAttributes(attribute.String("app.idempotency.result", "conflict"))
+				writeProblem(ctx, w, r, errIdempotencyKeyReused)
+				return
+			}
+			result := "hit"
+			select {
+			case <-response.done:
+			default:
+				result = "in_flight"
+				select {
+				case <-response.done:
+				case <-ctx.Done():
+					return
+				}
+			}
+			if response.status == 0 {
+				// The first request wrote nothing, as when its handler panics, so there is nothing
+				// to replay. It isn't kept either, so this one starts over.
+				span.AddEvent("rerun")
+				continue
+			}
+			span.SetAttributes(
+				attribute.String("app.idempotency.result", result),
+				attribute.Int("app.idempotency.replayed_status", response.status),
+			)
+			for name, values := range response.header {
+				w.Header()[name] = values
+			}
+			w.Header().Set(replayedHeader, "true")
+			w.WriteHeader(response.status)
+			w.Write(response.body)
+			return
+		}
+	})
+}
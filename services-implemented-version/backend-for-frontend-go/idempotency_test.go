@@ -0,0 +1,165 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testIdempotencyCache(maxBytes int64) *idempotencyCache {
+	return newIdempotencyCache(idempotencyConfig{TTL: time.Minute, MaxEntries: 10, MaxBytes: maxBytes})
+}
+
+// post sends a POST with an Idempotency-Key through handler.
+func post(handler http.Handler, key, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/createPicture", strings.NewReader(body))
+	r.RemoteAddr = "203.0.113.7:5000"
+	r.Header.Set(idempotencyHeader, key)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+// memeHandler answers each request with a new meme, counting how many it made.
+func memeHandler(calls *atomic.Int32) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "image/png")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(strings.Repeat("x", int(n))))
+	})
+}
+
+func TestIdempotencyReplays(t *testing.T) {
+	var calls atomic.Int32
+	handler := testIdempotencyCache(1 << 20).middleware(memeHandler(&calls))
+
+	first := post(handler, "k1", `{"phrase":"hi"}`)
+	second := post(handler, "k1", `{"phrase":"hi"}`)
+	if calls.Load() != 1 {
+		t.Fatalf("the handler ran %d times, want once", calls.Load())
+	}
+	if second.Code != first.Code || second.Body.String() != first.Body.String() {
+		t.Errorf("replayed %d %q, want %d %q", second.Code, second.Body, first.Code, first.Body)
+	}
+	if second.Header().Get(replayedHeader) != "true" || second.Header().Get("Content-Type") != "image/png" {
+		t.Errorf("replayed headers %v", second.Header())
+	}
+
+	// Another key is another request.
+	post(handler, "k2", `{"phrase":"hi"}`)
+	if calls.Load() != 2 {
+		t.Errorf("the handler ran %d times, want twice", calls.Load())
+	}
+}
+
+func TestIdempotencyRefusesAChangedRequest(t *testing.T) {
+	var calls atomic.Int32
+	handler := testIdempotencyCache(1 << 20).middleware(memeHandler(&calls))
+
+	post(handler, "k1", `{"phrase":"hi"}`)
+	if w := post(handler, "k1", `{"phrase":"bye"}`); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("status = %d for a different body, want 422", w.Code)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("the handler ran %d times, want once", calls.Load())
+	}
+}
+
+func TestIdempotencyWaitsForTheFirstRequest(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+	handler := testIdempotencyCache(1 << 20).middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			<-release
+		}
+		w.Write([]byte("meme"))
+	}))
+
+	var first *httptest.ResponseRecorder
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		first = post(handler, "k1", "")
+	}()
+	for calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		close(release)
+	}()
+	second := post(handler, "k1", "")
+	wg.Wait()
+	if calls.Load() != 1 || second.Body.String() != "meme" || first.Body.String() != "meme" {
+		t.Errorf("ran %d times, answering %q and %q, want once with the same meme", calls.Load(), first.Body, second.Body)
+	}
+}
+
+func TestIdempotencyRerunsWhenTheFirstRequestWroteNothing(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+	handler := testIdempotencyCache(1 << 20).middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			<-release
+			return
+		}
+		w.Write([]byte("meme"))
+	}))
+
+	go post(handler, "k1", "")
+	for calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		close(release)
+	}()
+	w := post(handler, "k1", "")
+	if w.Code != http.StatusOK || w.Body.String() != "meme" || calls.Load() != 2 {
+		t.Errorf("got %d %q after %d runs, want the retry to make the meme itself", w.Code, w.Body, calls.Load())
+	}
+}
+
+func TestIdempotencyDoesNotKeepServerErrors(t *testing.T) {
+	var calls atomic.Int32
+	handler := testIdempotencyCache(1 << 20).middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("meme"))
+	}))
+	post(handler, "k1", "")
+	if w := post(handler, "k1", ""); w.Code != http.StatusOK || calls.Load() != 2 {
+		t.Errorf("retry got %d after %d runs, want a fresh 200", w.Code, calls.Load())
+	}
+}
+
+func TestIdempotencyEvictsOldestPastMaxBytes(t *testing.T) {
+	var calls atomic.Int32
+	cache := testIdempotencyCache(4)
+	handler := cache.middleware(memeHandler(&calls))
+
+	post(handler, "k1", "") // 1 byte
+	post(handler, "k2", "") // 2 bytes
+	post(handler, "k3", "") // 3 bytes: k1 and k2 make way
+	if cache.bytes > 4 || cache.order.Len() != 1 {
+		t.Errorf("%d responses of %d bytes kept, want k3's 3 alone", cache.order.Len(), cache.bytes)
+	}
+	post(handler, "k1", "")
+	if calls.Load() != 4 {
+		t.Errorf("the handler ran %d times, want k1 run again", calls.Load())
+	}
+	post(handler, "k1", "") // now kept, and replayed
+	if calls.Load() != 4 {
+		t.Errorf("the handler ran %d times, want k1 replayed", calls.Load())
+	}
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type jobStatus string
+
+const (
+	jobQueued    jobStatus = "queued"
+	jobRendering jobStatus = "rendering"
+	jobDone      jobStatus = "done"
+	jobFailed    jobStatus = "failed"
+)
+
+// jobConfig sizes the background rendering pool.
+type jobConfig struct {
+	Workers   int
+	QueueSize int
+	Timeout   time.Duration // how long one job may take
+	Retention time.Duration // how long finished jobs are kept
+	MaxKept   int           // finished jobs kept at most, dropping the oldest first
+	MaxBytes  int64         // images kept for unsaved memes at most, dropping the oldest first
+}
+
+// jobConfigFromEnv reads the JOB_* environment variables, falling back to defaults.
+func jobConfigFromEnv() jobConfig {
+	return jobConfig{
+		Workers:   envInt("JOB_WORKERS", 4),
+		QueueSize: envInt("JOB_QUEUE_SIZE", 100),
+		Timeout:   envDuration("JOB_TIMEOUT", 2*time.Minute),
+		Retention: envDuration("JOB_RETENTION", time.Hour),
+		MaxKept:   envInt("JOB_MAX_KEPT", 500),
+		MaxBytes:  int64(envInt("JOB_MAX_BYTES", 64<<20)),
+	}
+}
+
+// memeJob is one meme rendered in the background.
+type memeJob struct {
+	id      string
+	request createPictureRequest
+	link    trace.Link // to the span of the request that submitted the job
+
+	mu      sync.Mutex
+	status  jobStatus
+	created time.Time
+	updated time.Time
+	inputs  *memeInputs
+	result  *cachedMeme // only kept when the meme isn't saved, and then only while there is room
+	problem *problem
+	saved   bool // in the gallery, under the job's ID
+}
+
+func (j *memeJob) setStatus(status jobStatus) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.status = status
+	j.updated = time.Now()
+}
+
+// jobView is the JSON form of a job.
+type jobView struct {
+	ID       string            `json:"id"`
+	Status   jobStatus         `json:"status"`
+	Created  time.Time         `json:"created"`
+	Updated  time.Time         `json:"updated"`
+	Seed     int64             `json:"seed"`
+	Phrase   string            `json:"phrase,omitempty"`
+	ImageURL string            `json:"imageUrl,omitempty"`
+	Degraded []string          `json:"degraded,omitempty"`
+	Error    *problem          `json:"error,omitempty"`
+	Links    map[string]string `json:"links"`
+}
+
+func (j *memeJob) view(r *http.Request) jobView {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	v := jobView{
+		ID:      j.id,
+		Status:  j.status,
+		Created: j.created,
+		Updated: j.updated,
+		Seed:    *j.request.Seed,
+		Error:   j.problem,
+		Links: map[string]string{
+			"self":  publicPath(r, "/memes/"+j.id),
+			"image": publicPath(r, "/memes/"+j.id+"/image"),
+		},
+	}
+	if j.saved {
+		v.Links["permalink"] = permalink(r, j.id)
+	}
+	if j.inputs != nil {
+		v.Phrase = j.inputs.Phrase
+		v.ImageURL = j.inputs.ImageURL
+		v.Degraded = j.inputs.degraded.list()
+	}
+	return v
+}
+
+// imageURL is the meme's permalink if it was saved, or else the job's own image link.
+func (j *memeJob) imageURL(r *http.Request) string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.saved {
+		return permalink(r, j.id)
+	}
+	return publicPath(r, "/memes/"+j.id+"/image")
+}
+
+// isSaved says whether the meme is in the gallery, so that its imageURL lasts.
+func (j *memeJob) isSaved() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.saved
+}
+
+// jobQueue runs memeJobs on a fixed number of workers, independently of the requests that submitted them.
+// A job's result only changes with both mu and the job's own lock held, in that order.
+type jobQueue struct {
+	config jobConfig
+	queue  chan *memeJob
+
+	mu    sync.Mutex
+	jobs  map[string]*memeJob
+	bytes int64 // in the results kept
+}
+
+func newJobQueue(config jobConfig) *jobQueue {
+	return &jobQueue{
+		config: config,
+		queue:  make(chan *memeJob, config.QueueSize),
+		jobs:   map[string]*memeJob{},
+	}
+}
+
+var jobs = newJobQueue(jobConfigFromEnv())
+
+// start launches the workers. They stop when ctx is done.
+func (q *jobQueue) start(ctx context.Context) {
+	for i := 0; i < q.config.Workers; i++ {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case job := <-q.queue:
+					q.run(job)
+				}
+			}
+		}()
+	}
+}
+
+// submit queues a job, or fails straight away if the queue is full.
+func (q *jobQueue) submit(ctx context.Context, request createPictureRequest) (*memeJob, error) {
+	now := time.Now()
+	job := &memeJob{
+		id:      newMemeID(),
+		request: request,
+		link:    trace.LinkFromContext(ctx, attribute.String("app.link", "submitted_by")),
+		status:  jobQueued,
+		created: now,
+		updated: now,
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.sweep(now)
+	q.makeRoom()
+	select {
+	case q.queue <- job:
+	default:
+		return nil, &apiError{Status: http.StatusServiceUnavailable, Code: "queue_full", Title: "Too many memes are waiting to render, try again later"}
+	}
+	q.jobs[job.id] = job
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("app.job.id", job.id))
+	return job, nil
+}
+
+// sweep forgets finished jobs past their retention. It must be called with mu held.
+func (q *jobQueue) sweep(now time.Time) {
+	for id, job := range q.jobs {
+		job.mu.Lock()
+		if (job.status == jobDone || job.status == jobFailed) && now.Sub(job.updated) > q.config.Retention {
+			q.dropResult(job)
+			delete(q.jobs, id)
+		}
+		job.mu.Unlock()
+	}
+}
+
+// makeRoom drops the finished jobs that have been done longest while there are more than
+// MaxKept of them. It must be called with mu held.
+func (q *jobQueue) makeRoom() {
+	finished := q.finished(func(job *memeJob) bool { return true })
+	if len(finished) < q.config.MaxKept {
+		return
+	}
+	for _, job := range finished[:len(finished)-max(q.config.MaxKept-1, 0)] {
+		job.mu.Lock()
+		q.dropResult(job)
+		job.mu.Unlock()
+		delete(q.jobs, job.id)
+	}
+}
+
+// keepResult keeps the image of a job whose meme wasn't saved, dropping the images of the jobs
+// that have been done longest while they take more than MaxBytes. Those jobs are still listed,
+// but their image is gone. It must be called with mu held, but not the job's lock.
+func (q *jobQueue) keepResult(job *memeJob, result *cachedMeme) {
+	job.mu.Lock()
+	job.result = result
+	q.bytes += int64(len(result.Data))
+	job.mu.Unlock()
+
+	if q.bytes <= q.config.MaxBytes {
+		return
+	}
+	for _, job := range q.finished(func(job *memeJob) bool { return job.result != nil }) {
+		if q.bytes <= q.config.MaxBytes {
+			break
+		}
+		job.mu.Lock()
+		q.dropResult(job)
+		job.mu.Unlock()
+	}
+}
+
+// dropResult lets go of a job's image. It must be called with mu and the job's lock held.
+func (q *jobQueue) dropResult(job *memeJob) {
+	if job.result != nil {
+		q.bytes -= int64(len(job.result.Data))
+		job.result = nil
+	}
+}
+
+// finished lists the finished jobs that match, the one done longest first. It must be called with mu held.
+func (q *jobQueue) finished(match func(*memeJob) bool) []*memeJob {
+	var finished []*memeJob
+	updated := map[*memeJob]time.Time{}
+	for _, job := range q.jobs {
+		job.mu.Lock()
+		if (job.status == jobDone || job.status == jobFailed) && match(job) {
+			finished = append(finished, job)
+			updated[job] = job.updated
+		}
+		job.mu.Unlock()
+	}
+	sort.Slice(finished, func(i, j int) bool { return updated[finished[i]].Before(updated[finished[j]]) })
+	return finished
+}
+
+// record keeps a meme that was rendered outside the queue, so it can be fetched like a finished job.
+func (q *jobQueue) record(ctx context.Context, request createPictureRequest, inputs *memeInputs, result *cachedMeme) *memeJob {
+	now := time.Now()
+	job := &memeJob{
+		id:      newMemeID(),
+		request: request,
+		link:    trace.LinkFromContext(ctx),
+		status:  jobDone,
+		created: now,
+		updated: now,
+		inputs:  inputs,
+	}
+	job.saved = saveMeme(ctx, job.id, inputs, result)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.sweep(now)
+	q.makeRoom()
+	q.jobs[job.id] = job
+	if !job.saved {
+		q.keepResult(job, result)
+	}
+	return job
+}
+
+func (q *jobQueue) get(id string) (*memeJob, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job, ok := q.jobs[id]
+	return job, ok
+}
+
+// run renders a job in a trace of its own, linked to the trace that submitted it.
+// It does not use the submitting request's context, so the client can go away.
+func (q *jobQueue) run(job *memeJob) {
+	ctx, cancel := context.WithTimeout(context.Background(), q.config.Timeout)
+	defer cancel()
+	ctx, span := otel.Tracer("backend-for-frontend").Start(ctx, "renderMemeJob",
+		trace.WithNewRoot(),
+		trace.WithLinks(job.link),
+		trace.WithAttributes(attribute.String("app.job.id", job.id)),
+	)
+	defer span.End()
+	ctx = withSeed(ctx, *job.request.Seed)
+	span.SetAttributes(attribute.Int64("app.job.queue_ms", time.Since(job.created).Milliseconds()))
+
+	job.setStatus(jobRendering)
+	inputs, err := pickInputs(ctx, job.request, nil)
+	var result *cachedMeme
+	if err == nil {
+		job.mu.Lock()
+		job.inputs = inputs
+		job.mu.Unlock()
+		result, err = renderMeme(ctx, inputs, nil)
+	}
+
+	saved := err == nil && saveMeme(ctx, job.id, inputs, result)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	} else if inputs.degraded.list() != nil {
+		span.SetAttributes(attribute.String("app.degraded", inputs.degraded.String()))
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !saved && err == nil {
+		// Keep the image before the job shows as done, so a done job always has one to serve.
+		q.keepResult(job, result)
+	}
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	job.updated = time.Now()
+	if err != nil {
+		p := newProblem(span, "/memes/"+job.id, err)
+		job.problem = &p
+		job.status = jobFailed
+		return
+	}
+	job.saved = saved
+	job.status = jobDone
+}
+
+// submitMemeJob handles POST /memes. It takes the same body as /createPicture.
+func submitMemeJob(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	request, err := parseCreatePictureRequest(r)
+	if err != nil {
+		writeProblem(ctx, w, r, err)
+		return
+	}
+	ctx = request.ensureSeed(ctx)
+	w.Header().Set(seedHeader, strconv.FormatInt(*request.Seed, 10))
+
+	job, err := jobs.submit(ctx, request)
+	if err != nil {
+		writeProblem(ctx, w, r, err)
+		return
+	}
+	view := job.view(r)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", view.Links["self"])
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(view)
+}
+
+// getMemeJob handles GET /memes/{id}.
+func getMemeJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := jobs.get(r.PathValue("id"))
+	if !ok {
+		writeProblem(r.Context(), w, r, errJobNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job.view(r))
+}
+
+// getMemeJobImage handles GET /memes/{id}/image.
+func getMemeJobImage(w http.ResponseWriter, r *http.Request) {
+	job, ok := jobs.get(r.PathValue("id"))
+	if !ok {
+		writeProblem(r.Context(), w, r, errJobNotFound)
+		return
+	}
+	job.mu.Lock()
+	status, result, p, saved := job.status, job.result, job.problem, job.saved
+	job.mu.Unlock()
+
+	switch {
+	case status == jobDone && saved:
+		record, data, err := gallery.Load(r.Context(), job.id)
+		if err != nil {
+			writeProblem(r.Context(), w, r, err)
+			return
+		}
+		writeMeme(w, &cachedMeme{ContentType: record.ContentType, Data: data})
+	case status == jobDone && result != nil:
+		writeMeme(w, result)
+	case status == jobDone:
+		writeProblem(r.Context(), w, r, errJobImageGone)
+	case status == jobFailed:
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.WriteHeader(p.Status)
+		json.NewEncoder(w).Encode(p)
+	default:
+		w.Header().Set("Retry-After", "1")
+		writeProblem(r.Context(), w, r, &apiError{Status: http.StatusConflict, Code: "not_ready", Title: "The meme is still " + string(status)})
+	}
+}
+
+var errJobNotFound = &apiError{Status: http.StatusNotFound, Code: "not_found", Title: "No such meme job"}
+
+var errJobImageGone = &apiError{Status: http.StatusGone, Code: "image_gone", Title: "The meme's image is no longer kept"}
+
+// publicPath turns a BFF path into one the browser can use, adding the prefix nginx proxies it under.
+func publicPath(r *http.Request, path string) string {
+	return r.Header.Get("X-Forwarded-Prefix") + path
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func testJobQueue(config jobConfig) *jobQueue {
+	if config.Retention == 0 {
+		config.Retention = time.Hour
+	}
+	if config.MaxKept == 0 {
+		config.MaxKept = 100
+	}
+	if config.MaxBytes == 0 {
+		config.MaxBytes = 1 << 20
+	}
+	return newJobQueue(config)
+}
+
+// recordMeme records a finished meme of size bytes, as /createPicture does with the gallery off.
+func recordMeme(q *jobQueue, size int) *memeJob {
+	inputs := &memeInputs{Phrase: "test in prod", degraded: &degradation{}}
+	return q.record(context.Background(), createPictureRequest{}, inputs,
+		&cachedMeme{ContentType: "image/png", Data: make([]byte, size)})
+}
+
+// age makes a job look finished that long ago.
+func age(job *memeJob, by time.Duration) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	job.updated = job.updated.Add(-by)
+}
+
+func hasResult(job *memeJob) bool {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	return job.result != nil
+}
+
+func TestJobQueueSweepsExpiredJobs(t *testing.T) {
+	q := testJobQueue(jobConfig{Retention: time.Minute})
+	old := recordMeme(q, 10)
+	recent := recordMeme(q, 10)
+	age(old, 2*time.Minute)
+
+	// A job still rendering is kept however old it is.
+	rendering := &memeJob{id: "rendering", status: jobRendering, updated: time.Now().Add(-time.Hour)}
+	q.jobs[rendering.id] = rendering
+
+	q.mu.Lock()
+	q.sweep(time.Now())
+	q.mu.Unlock()
+	if _, ok := q.get(old.id); ok {
+		t.Error("an expired job is still kept")
+	}
+	if _, ok := q.get(recent.id); !ok {
+		t.Error("a recent job was swept")
+	}
+	if _, ok := q.get(rendering.id); !ok {
+		t.Error("a job still rendering was swept")
+	}
+	if q.bytes != 10 {
+		t.Errorf("%d bytes accounted for, want the 10 of the recent job", q.bytes)
+	}
+}
+
+func TestJobQueueKeepsAtMostMaxKept(t *testing.T) {
+	q := testJobQueue(jobConfig{MaxKept: 3})
+	var recorded []*memeJob
+	for i := 0; i < 5; i++ {
+		job := recordMeme(q, 10)
+		age(job, time.Duration(5-i)*time.Minute)
+		recorded = append(recorded, job)
+	}
+	if len(q.jobs) != 3 {
+		t.Fatalf("%d jobs kept, want 3", len(q.jobs))
+	}
+	for i, job := range recorded {
+		if _, ok := q.get(job.id); ok != (i >= 2) {
+			t.Errorf("job %d kept = %v, want only the newest 3 kept", i, ok)
+		}
+	}
+	if q.bytes != 30 {
+		t.Errorf("%d bytes accounted for, want 30", q.bytes)
+	}
+}
+
+func TestJobQueueBoundsKeptImages(t *testing.T) {
+	q := testJobQueue(jobConfig{MaxBytes: 250})
+	var recorded []*memeJob
+	for i := 0; i < 4; i++ {
+		job := recordMeme(q, 100)
+		age(job, time.Duration(4-i)*time.Minute)
+		recorded = append(recorded, job)
+	}
+	if q.bytes > q.config.MaxBytes {
+		t.Errorf("%d bytes kept, more than the %d allowed", q.bytes, q.config.MaxBytes)
+	}
+	for i, job := range recorded {
+		if hasResult(job) != (i >= 2) {
+			t.Errorf("job %d has its image = %v, want only the newest 2 to", i, hasResult(job))
+		}
+		if _, ok := q.get(job.id); !ok {
+			t.Errorf("job %d was forgotten along with its image", i)
+		}
+	}
+
+	// The job is still there, but its image is gone.
+	saved := jobs
+	jobs = q
+	defer func() { jobs = saved }()
+	r := httptest.NewRequest(http.MethodGet, "/memes/"+recorded[0].id+"/image", nil)
+	r.SetPathValue("id", recorded[0].id)
+	w := httptest.NewRecorder()
+	getMemeJobImage(w, r)
+	if w.Code != http.StatusGone {
+		t.Errorf("status = %d for a dropped image, want 410", w.Code)
+	}
+	r = httptest.NewRequest(http.MethodGet, "/memes/"+recorded[3].id+"/image", nil)
+	r.SetPathValue("id", recorded[3].id)
+	w = httptest.NewRecorder()
+	getMemeJobImage(w, r)
+	if w.Code != http.StatusOK || w.Body.Len() != 100 {
+		t.Errorf("got %d with %d bytes for a kept image, want 200 with 100", w.Code, w.Body.Len())
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// apiKey is who a key was issued to and how many requests it may make in a day. A DailyQuota
+// of zero means no limit.
+type apiKey struct {
+	Owner      string `json:"owner"`
+	DailyQuota int64  `json:"dailyQuota"`
+}
+
+// keyStore looks up API keys and counts their use. Keys only ever reach a store as hashes.
+type keyStore interface {
+	Lookup(ctx context.Context, keyHash string) (apiKey, bool, error)
+	// Use counts n requests for the key on day, unless that would go over quota.
+	// It returns the count for the day either way.
+	Use(ctx context.Context, keyHash string, day string, n, quota int64) (used int64, allowed bool, err error)
+}
+
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// dailyUsage is how many requests a key has made on one day.
+type dailyUsage struct {
+	Day   string `json:"day"`
+	Count int64  `json:"count"`
+}
+
+// memoryKeyStore keeps usage in memory, so it starts again from zero when the BFF restarts.
+type memoryKeyStore struct {
+	mu    sync.Mutex
+	keys  map[string]apiKey
+	usage map[string]dailyUsage
+}
+
+// newMemoryKeyStore reads keys written as owner:key[:dailyQuota], separated by commas.
+func newMemoryKeyStore(spec string) (*memoryKeyStore, error) {
+	s := &memoryKeyStore{keys: map[string]apiKey{}, usage: map[string]dailyUsage{}}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, ":")
+		if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("API_KEYS entries look like owner:key[:dailyQuota]")
+		}
+		key := apiKey{Owner: parts[0]}
+		if len(parts) == 3 {
+			quota, err := strconv.ParseInt(parts[2], 10, 64)
+			if err != nil || quota < 0 {
+				return nil, fmt.Errorf("bad daily quota for %s: %q", key.Owner, parts[2])
+			}
+			key.DailyQuota = quota
+		}
+		s.keys[hashKey(parts[1])] = key
+	}
+	return s, nil
+}
+
+func (s *memoryKeyStore) Lookup(ctx context.Context, keyHash string) (apiKey, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, ok := s.keys[keyHash]
+	return key, ok, nil
+}
+
+func (s *memoryKeyStore) Use(ctx context.Context, keyHash string, day string, n, quota int64) (int64, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	used, allowed := use(s.usage, keyHash, day, n, quota)
+	return used, allowed, nil
+}
+
+// use counts n requests against usage, starting a fresh count on a new day. They are counted
+// all together or not at all.
+func use(usage map[string]dailyUsage, keyHash string, day string, n, quota int64) (int64, bool) {
+	current := usage[keyHash]
+	if current.Day != day {
+		current = dailyUsage{Day: day}
+	}
+	if quota > 0 && current.Count+n > quota {
+		return current.Count, false
+	}
+	current.Count += n
+	usage[keyHash] = current
+	return current.Count, true
+}
+
+// unuse takes back n requests that use counted, unless the day has moved on since.
+func unuse(usage map[string]dailyUsage, keyHash string, day string, n int64) int64 {
+	current := usage[keyHash]
+	if current.Day == day {
+		current.Count = max(current.Count-n, 0)
+		usage[keyHash] = current
+	}
+	return current.Count
+}
+
+// keyFile is the file behind fileKeyStore. Operators write the keys; the BFF keeps usage up to date.
+type keyFile struct {
+	Keys []struct {
+		Key string `json:"key"`
+		apiKey
+	} `json:"keys"`
+	Usage map[string]dailyUsage `json:"usage,omitempty"` // by key hash
+}
+
+// fileKeyStore keeps keys and usage in a JSON file, so counts survive a restart. A request isn't
+// let through until its count is on disk, but requests that arrive while the file is being
+// written share the next write, rather than each rewriting it in turn.
+type fileKeyStore struct {
+	path string
+
+	mu      sync.Mutex
+	written *sync.Cond // broadcast after every write
+	keys    map[string]apiKey
+	file    keyFile
+	changes int64 // usage changes made so far
+	saved   int64 // usage changes on disk
+	writing bool
+}
+
+func newFileKeyStore(path string) (*fileKeyStore, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &fileKeyStore{path: path, keys: map[string]apiKey{}}
+	s.written = sync.NewCond(&s.mu)
+	if err := json.Unmarshal(data, &s.file); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	for _, entry := range s.file.Keys {
+		if entry.Key == "" || entry.Owner == "" {
+			return nil, fmt.Errorf("every key in %s needs a key and an owner", path)
+		}
+		s.keys[hashKey(entry.Key)] = entry.apiKey
+	}
+	if s.file.Usage == nil {
+		s.file.Usage = map[string]dailyUsage{}
+	}
+	return s, nil
+}
+
+func (s *fileKeyStore) Lookup(ctx context.Context, keyHash string) (apiKey, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, ok := s.keys[keyHash]
+	return key, ok, nil
+}
+
+func (s *fileKeyStore) Use(ctx context.Context, keyHash string, day string, n, quota int64) (int64, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	used, allowed := use(s.file.Usage, keyHash, day, n, quota)
+	if !allowed {
+		return used, false, nil
+	}
+	s.changes++
+	change := s.changes
+	for s.saved < change {
+		if s.writing {
+			// The write under way may have started before this change; wait and see.
+			s.written.Wait()
+			continue
+		}
+		if err := s.save(); err != nil {
+			// Don't count a request that is refused for want of saving it.
+			return unuse(s.file.Usage, keyHash, day, n), false, err
+		}
+	}
+	return used, true, nil
+}
+
+// save writes every change made so far. It must be called with mu held, and lets go of it while
+// writing, so that more changes can queue up for the next write.
+func (s *fileKeyStore) save() error {
+	data, err := json.MarshalIndent(s.file, "", "  ")
+	if err != nil {
+		return err
+	}
+	changes := s.changes
+	s.writing = true
+	s.mu.Unlock()
+	err = writeFileAtomic(s.path, data)
+	s.mu.Lock()
+	s.writing = false
+	if err == nil {
+		s.saved = max(s.saved, changes)
+	}
+	s.written.Broadcast()
+	return err
+}
+
+// writeFileAtomic writes a file through a temporary one, so a crash never leaves it half written.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".keys-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// openKeyStore picks the store from the environment: API_KEYS_FILE for a file, or API_KEYS for
+// keys kept in memory. With neither, it returns nil and the BFF stays open to everyone.
+func openKeyStore() (keyStore, error) {
+	if path := os.Getenv("API_KEYS_FILE"); path != "" {
+		return newFileKeyStore(path)
+	}
+	if spec := os.Getenv("API_KEYS"); spec != "" {
+		return newMemoryKeyStore(spec)
+	}
+	return nil, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// writeKeyFile writes a key file with one key, "secret", for team with the given quota.
+func writeKeyFile(t *testing.T, quota int64) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "keys.json")
+	data, _ := json.Marshal(map[string]any{"keys": []map[string]any{{"key": "secret", "owner": "team", "dailyQuota": quota}}})
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestMemoryKeyStore(t *testing.T) {
+	store, err := newMemoryKeyStore("team:secret:3, other:key2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if key, ok, _ := store.Lookup(ctx, hashKey("secret")); !ok || key.Owner != "team" || key.DailyQuota != 3 {
+		t.Errorf("Lookup = %+v, %v, want team's key with a quota of 3", key, ok)
+	}
+	if _, ok, _ := store.Lookup(ctx, hashKey("guess")); ok {
+		t.Error("an unknown key was found")
+	}
+
+	for _, tt := range []struct {
+		day     string
+		n       int64
+		used    int64
+		allowed bool
+	}{
+		{"2024-01-01", 2, 2, true},
+		{"2024-01-01", 2, 2, false}, // all or nothing
+		{"2024-01-01", 1, 3, true},
+		{"2024-01-01", 1, 3, false},
+		{"2024-01-02", 1, 1, true}, // a new day starts over
+	} {
+		used, allowed, _ := store.Use(ctx, hashKey("secret"), tt.day, tt.n, 3)
+		if used != tt.used || allowed != tt.allowed {
+			t.Errorf("Use(%s, %d) = %d, %v, want %d, %v", tt.day, tt.n, used, allowed, tt.used, tt.allowed)
+		}
+	}
+
+	for _, spec := range []string{"nokey", "team:", "team:key:lots", "team:key:-1"} {
+		if _, err := newMemoryKeyStore(spec); err == nil {
+			t.Errorf("newMemoryKeyStore(%q) accepted it", spec)
+		}
+	}
+}
+
+func TestFileKeyStoreKeepsUsageAcrossRestarts(t *testing.T) {
+	path := writeKeyFile(t, 100)
+	store, err := newFileKeyStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, allowed, err := store.Use(ctx, hashKey("secret"), "2024-01-01", 1, 100); !allowed || err != nil {
+				t.Errorf("Use = %v, %v", allowed, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	reopened, err := newFileKeyStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reopened.file.Usage[hashKey("secret")].Count; got != 20 {
+		t.Errorf("%d requests on disk, want all 20", got)
+	}
+	if _, ok, _ := reopened.Lookup(ctx, hashKey("secret")); !ok {
+		t.Error("the key was lost in saving usage")
+	}
+}
+
+func TestFileKeyStoreTakesBackWhatItCouldNotSave(t *testing.T) {
+	path := writeKeyFile(t, 100)
+	store, err := newFileKeyStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	store.Use(ctx, hashKey("secret"), "2024-01-01", 1, 100)
+
+	// Something in the way of the file makes the next write fail, even for root.
+	os.Remove(path)
+	os.MkdirAll(filepath.Join(path, "in-the-way"), 0o755)
+	used, allowed, err := store.Use(ctx, hashKey("secret"), "2024-01-01", 5, 100)
+	if err == nil || allowed {
+		t.Fatalf("Use = %v, %v, want the write's error", allowed, err)
+	}
+	if used != 1 || store.file.Usage[hashKey("secret")].Count != 1 {
+		t.Errorf("count is %d after a failed write, want it back at 1", store.file.Usage[hashKey("secret")].Count)
+	}
+
+	os.RemoveAll(path)
+	if used, allowed, err := store.Use(ctx, hashKey("secret"), "2024-01-01", 1, 100); used != 2 || !allowed || err != nil {
+		t.Errorf("Use = %d, %v, %v once the file can be written, want 2", used, allowed, err)
+	}
+}
@@ -1,112 +1,100 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 
-	"go.opentelemetry.io/contrib/instrumentation/net/http/httptrace/otelhttptrace"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"go.opentelemetry.io/otel"
-	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
-	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
-	"go.opentelemetry.io/otel/propagation"
-	sdktrace "go.opentelemetry.io/otel/sdk/trace"
-)
+	"go.opentelemetry.io/otel/attribute"
 
-const (
-	port         = 10115
-	imagePicker  = "http://image-picker:10116/imageUrl"
-	meminator    = "http://meminator:10117/applyPhraseToPicture"
-	phrasePicker = "http://phrase-picker:10118/phrase"
+	"telemetry"
 )
 
-type FetchOptions struct {
-	Method string
-	Body   interface{}
-}
-
-func fetchFromService(ctx context.Context, url string, options *FetchOptions) (*http.Response, error) {
-	var (
-		req *http.Request
-		err error
-	)
+const port = 10115
 
-	if options != nil && options.Body != nil {
-		body, err := json.Marshal(options.Body)
-		if err != nil {
-			return nil, err
-		}
-		req, _ = http.NewRequestWithContext(ctx, options.Method, url, bytes.NewBuffer(body))
-		ctx, req = otelhttptrace.W3C(ctx, req)
-		otelhttptrace.Inject(ctx, req)
-		req.Header.Set("Content-Type", "application/json")
-	} else {
-		req, err = http.NewRequestWithContext(ctx, "GET", url, nil)
-		ctx, req = otelhttptrace.W3C(ctx, req)
-		otelhttptrace.Inject(ctx, req)
-	}
-	if err != nil {
-		return nil, err
-	}
+// Downstream services. These are variables so tests can point them at local servers.
+var (
+	transport    = transportConfigFromEnv()
+	imagePicker  = newDownstream("image-picker", "http://image-picker:10116/imageUrl", envDuration("IMAGE_PICKER_TIMEOUT", 2*time.Second), transport)
+	meminator    = newDownstream("meminator", "http://meminator:10117/applyPhraseToPicture", envDuration("MEMINATOR_TIMEOUT", 30*time.Second), transport)
+	phrasePicker = newDownstream("phrase-picker", "http://phrase-picker:10118/phrase", envDuration("PHRASE_PICKER_TIMEOUT", 2*time.Second), transport)
 
-	client := &http.Client{}
-	return client.Do(req)
-}
+	// imageSource fetches the original picture directly, for when meminator can't annotate it.
+	imageSource = onlyImageHosts(newDownstream("image-source", "", envDuration("IMAGE_SOURCE_TIMEOUT", 10*time.Second), transport))
+)
 
 func createPicture(w http.ResponseWriter, r *http.Request) {
-	ctx, span := otel.Tracer("backend-for-frontend").Start(context.Background(), "createPicture")
+	// Start from the request context so this span joins the server span from otelhttp,
+	// and so the client going away cancels the downstream calls.
+	ctx, span := otel.Tracer("backend-for-frontend").Start(r.Context(), "createPicture")
 	defer span.End()
-	phraseResponse, err := fetchFromService(ctx, phrasePicker, nil)
-	if err != nil || phraseResponse.StatusCode != http.StatusOK {
-		http.Error(w, "Failed to fetch phrase", http.StatusInternalServerError)
+
+	request, err := parseCreatePictureRequest(r)
+	if err != nil {
+		writeProblem(ctx, w, r, err)
 		return
 	}
-	defer phraseResponse.Body.Close()
-	var phraseResult map[string]interface{}
-	if err := json.NewDecoder(phraseResponse.Body).Decode(&phraseResult); err != nil {
-		http.Error(w, "Failed to decode phrase response", http.StatusInternalServerError)
+	w.Header().Set("Vary", "Accept")
+	envelope, err := negotiateFormat(r, &request)
+	if err != nil {
+		writeProblem(ctx, w, r, err)
 		return
 	}
+	ctx = request.ensureSeed(ctx)
+	w.Header().Set(seedHeader, strconv.FormatInt(*request.Seed, 10))
 
-	imageResponse, err := fetchFromService(ctx, imagePicker, nil)
-	if err != nil || imageResponse.StatusCode != http.StatusOK {
-		http.Error(w, "Failed to fetch image", http.StatusInternalServerError)
+	inputs, err := pickInputs(ctx, request, nil)
+	if err != nil {
+		writeProblem(ctx, w, r, err)
 		return
 	}
-	defer imageResponse.Body.Close()
-	var imageResult map[string]interface{}
-	if err := json.NewDecoder(imageResponse.Body).Decode(&imageResult); err != nil {
-		http.Error(w, "Failed to decode image response", http.StatusInternalServerError)
+
+	etag := `"` + inputs.key() + `"`
+	if !envelope && etagMatches(r.Header.Get("If-None-Match"), etag) {
+		span.SetAttributes(attribute.Bool("app.cache.not_modified", true))
+		inputs.degraded.apply(w, span)
+		w.Header().Set("ETag", etag)
+		w.WriteHeader(http.StatusNotModified)
 		return
 	}
 
-	meminatorResponse, err := fetchFromService(ctx, meminator, &FetchOptions{
-		Method: "POST",
-		Body:   mergeMaps(phraseResult, imageResult),
-	})
-	if err != nil || meminatorResponse.StatusCode != http.StatusOK {
-		http.Error(w, "Failed to fetch picture from meminator", http.StatusInternalServerError)
+	started := time.Now()
+	picture, err := renderMeme(ctx, inputs, nil)
+	if err != nil {
+		writeProblem(ctx, w, r, err)
 		return
 	}
-	defer meminatorResponse.Body.Close()
-
-	w.Header().Set("Content-Type", "image/png")
-	if _, err := io.Copy(w, meminatorResponse.Body); err != nil {
-		http.Error(w, "Failed to stream picture data", http.StatusInternalServerError)
+	renderTime := time.Since(started)
+	id := newMemeID()
+	saved := saveMeme(ctx, id, inputs, picture)
+	if saved {
+		w.Header().Set("Content-Location", permalink(r, id))
 	}
+	inputs.degraded.apply(w, span)
+	if envelope {
+		writeMemeEnvelope(ctx, w, newMemeEnvelope(ctx, r, id, saved, inputs, picture, renderTime))
+		return
+	}
+	writeMeme(w, picture)
 }
 
-func mergeMaps(m1, m2 map[string]interface{}) map[string]interface{} {
-	for k, v := range m2 {
-		m1[k] = v
+// writeMeme sends a picture. Only cacheable pictures get an ETag.
+func writeMeme(w http.ResponseWriter, meme *cachedMeme) {
+	w.Header().Set("Content-Type", meme.ContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(meme.Data)))
+	if meme.Key != "" {
+		w.Header().Set("ETag", `"`+meme.Key+`"`)
 	}
-	return m1
+	w.Write(meme.Data)
 }
 
 func healthCheck(w http.ResponseWriter, r *http.Request) {
@@ -118,49 +106,79 @@ func healthCheck(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("OK"))
 }
 
-func main() {
-	// Initialize OpenTelemetry Tracer
-	tracerProvider, err := initTracer()
-	if err != nil {
-		log.Fatalf("failed to initialize tracer: %v", err)
+func newHandler() http.Handler {
+	mux := http.NewServeMux()
+	// Endpoints that make memes need an API key, when keys are configured, and are rate limited.
+	// Retried POSTs with the same Idempotency-Key get the first response back. Only requests that
+	// get past both count against the key's daily quota.
+	metered := func(handler http.HandlerFunc) http.Handler {
+		return auth.middleware(idempotency.middleware(limiter.middleware(auth.quota(handler))))
 	}
-	defer func() { _ = tracerProvider.Shutdown(context.Background()) }()
+	// otelhttp makes the server span and records request counts, durations and sizes by route.
+	handle := func(pattern, operation string, handler http.Handler) {
+		mux.Handle(pattern, otelhttp.NewHandler(otelhttp.WithRouteTag(telemetry.Route(pattern), handler), operation))
+	}
+	handle("/createPicture", "createPicture", metered(createPicture))
+	handle("POST /createPictures", "createPictures", weighBatch(metered(createPictures)))
+	handle("GET /createPicture/stream", "createPictureStream", metered(createPictureStream))
+	handle("POST /memes", "submitMemeJob", metered(submitMemeJob))
+	handle("GET /memes", "listMemes", http.HandlerFunc(listMemes))
+	handle("GET /memes/{id}", "getMemeJob", http.HandlerFunc(getMemeJob))
+	handle("POST /memes/{id}/remix", "remixMeme", metered(remixMeme))
+	handle("GET /memes/{id}/image", "getMemeJobImage", http.HandlerFunc(getMemeJobImage))
+	handle("GET /m/{id}", "getPermalink", http.HandlerFunc(getPermalink))
+	handle("GET /m/{id}/chain", "getRemixChain", http.HandlerFunc(getRemixChain))
+	handle("/breakers", "breakerStates", http.HandlerFunc(breakerStates))
+	handle("/fallback.png", "fallbackImage", http.HandlerFunc(serveFallbackImage))
+	handle("/health", "healthCheck", http.HandlerFunc(healthCheck))
+	return telemetry.ActiveRequests(mux)
+}
 
-	http.Handle("/createPicture", otelhttp.NewHandler(http.HandlerFunc(createPicture), "createPicture"))
-	http.Handle("/health", otelhttp.NewHandler(http.HandlerFunc(healthCheck), "healthCheck"))
+func main() {
+	// Stop on Ctrl-C or docker stop, so telemetry still buffered gets sent
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	fmt.Printf("Server is running on http://localhost:%d\n", port)
-	if err := http.ListenAndServe(fmt.Sprintf(":%d", port), nil); err != nil {
-		fmt.Fprintf(os.Stderr, "Error starting server: %v\n", err)
+	// Send traces, metrics and logs as the OTEL_* environment variables say
+	shutdownTelemetry, err := telemetry.Start(ctx, "backend-for-frontend")
+	if err != nil {
+		slog.Error("failed to start telemetry", "error", err)
+		os.Exit(1)
+	}
+	defer func() { _ = shutdownTelemetry(context.Background()) }()
+	// fatal logs why the BFF can't go on, sends what telemetry it can, and exits.
+	fatal := func(msg string, err error) {
+		slog.Error(msg, "error", err)
+		_ = shutdownTelemetry(context.Background())
 		os.Exit(1)
 	}
-}
-
-func initTracer() (*sdktrace.TracerProvider, error) {
 
-	ctx := context.Background()
-	// Configure a new OTLP exporter using environment variables for sending data to Honeycomb over gRPC
-	client := otlptracehttp.NewClient()
-	exp, err := otlptrace.New(ctx, client)
+	gallery, err = openMemeStore(ctx, storageConfigFromEnv())
 	if err != nil {
-		log.Fatalf("failed to initialize exporter: %e", err)
+		fatal("failed to open meme storage", err)
 	}
 
-	// Create a new trace provider with the exporter
-	tp := sdktrace.NewTracerProvider(
-		sdktrace.WithBatcher(exp),
-	)
+	keys, err := openKeyStore()
+	if err != nil {
+		fatal("failed to load API keys", err)
+	}
+	auth = newAuthenticator(keys)
 
-	// Register the trace provider as the global provider
-	otel.SetTracerProvider(tp)
+	jobs.start(ctx)
+	idempotency.start(ctx)
 
-	// Register the W3C trace context and baggage propagators so data is propagated across services/processes
-	otel.SetTextMapPropagator(
-		propagation.NewCompositeTextMapPropagator(
-			propagation.TraceContext{},
-			propagation.Baggage{},
-		),
-	)
+	server := &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: newHandler()}
+	go func() {
+		slog.Info("server is running", "url", fmt.Sprintf("http://localhost:%d", port))
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fatal("failed to start server", err)
+		}
+	}()
+	<-ctx.Done()
 
-	return tp, nil
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("failed to stop server", "error", err)
+	}
 }
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// fakeService serves a fixed response behind otelhttp, the way the real services sit behind otelecho.
+func fakeService(t *testing.T, name string, contentType string, body []byte) *httptest.Server {
+	t.Helper()
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.Write(body)
+	})
+	server := httptest.NewServer(otelhttp.NewHandler(handler, name))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestCreatePictureIsOneTrace(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	phraseBody, _ := json.Marshal(map[string]string{"phrase": "test in prod"})
+	imageBody, _ := json.Marshal(map[string]string{"imageUrl": "https://example.com/cat.png"})
+	phraseServer := fakeService(t, "phrase-picker", "application/json", phraseBody)
+	imageServer := fakeService(t, "image-picker", "application/json", imageBody)
+	meminatorServer := fakeService(t, "meminator", "image/png", []byte("png"))
+	phrasePicker.url = phraseServer.URL + "/phrase"
+	imagePicker.url = imageServer.URL + "/imageUrl"
+	meminator.url = meminatorServer.URL + "/applyPhraseToPicture"
+
+	bff := httptest.NewServer(newHandler())
+	t.Cleanup(bff.Close)
+
+	// Pretend the browser already started the trace.
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req, _ := http.NewRequest("POST", bff.URL+"/createPicture", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	// Close waits for in-flight handlers, so every server span has ended after this.
+	for _, server := range []*httptest.Server{bff, phraseServer, imageServer, meminatorServer} {
+		server.Close()
+	}
+	spans := recorder.Ended()
+	names := map[string]bool{}
+	for _, span := range spans {
+		names[span.Name()] = true
+		if got := span.SpanContext().TraceID().String(); got != traceID {
+			t.Errorf("span %q has trace ID %s, want %s", span.Name(), got, traceID)
+		}
+	}
+	for _, want := range []string{"createPicture", "fetchPhrase", "fetchImage", "GET", "POST", "phrase-picker", "image-picker", "meminator"} {
+		if !names[want] {
+			t.Errorf("no span named %q in %v", want, names)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/errgroup"
+)
+
+// memeInputs is everything that decides what a meme looks like.
+type memeInputs struct {
+	Phrase   string
+	ImageURL string
+	Style    *memeStyle
+	Format   string
+	Seed     int64
+	degraded *degradation
+}
+
+func (in *memeInputs) key() string {
+	return cacheKey(in.Phrase, in.ImageURL, in.Style, in.Format)
+}
+
+// progressFunc is told about each stage of making a meme as it is reached.
+// It may be called from more than one goroutine at once.
+type progressFunc func(stage string, data map[string]interface{})
+
+func (p progressFunc) report(stage string, data map[string]interface{}) {
+	if p != nil {
+		p(stage, data)
+	}
+}
+
+// ensureSeed picks a seed if the client didn't send one, and adds it to the baggage in ctx.
+// The same seed makes the pickers choose the same phrase and image again.
+func (req *createPictureRequest) ensureSeed(ctx context.Context) context.Context {
+	if req.Seed == nil {
+		seed := newSeed()
+		req.Seed = &seed
+	}
+	return withSeed(ctx, *req.Seed)
+}
+
+// pickInputs chooses the phrase and the image. They don't depend on each other, so they are
+// fetched at the same time, skipping whichever one the client pinned.
+// If either one fails without a fallback, the group's context cancels the other, which then
+// doesn't fall back either: it was stopped, not let down. A picker
+// refusing what the client asked for, such as an unknown category, is the client's error and
+// never falls back.
+func pickInputs(ctx context.Context, request createPictureRequest, progress progressFunc) (*memeInputs, error) {
+	seed := *request.Seed
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.Int64("app.seed", seed),
+		attribute.Bool("app.phrase.pinned", request.Phrase != ""),
+		attribute.Bool("app.image.pinned", request.ImageURL != ""),
+		attribute.String("app.phrase.category", request.PhraseCategory),
+		attribute.String("app.image.tag", request.ImageTag),
+	)
+
+	phraseResult := map[string]interface{}{"phrase": request.Phrase}
+	imageResult := map[string]interface{}{"imageUrl": request.ImageURL}
+	degraded := &degradation{}
+	g, gctx := errgroup.WithContext(ctx)
+	if request.Phrase != "" {
+		progress.report("phrase", phraseResult)
+	} else {
+		g.Go(func() error {
+			query := url.Values{"seed": {strconv.FormatInt(pickerSeed(seed, "phrase"), 10)}}
+			if request.PhraseCategory != "" {
+				query.Set("category", request.PhraseCategory)
+			}
+			err := rejection(fetchJSON(gctx, "fetchPhrase", phrasePicker, "phrase", query, &phraseResult))
+			if fallbacks.Phrase && degradable(gctx, err) {
+				degraded.add(ctx, "phrase", err)
+				phraseResult = map[string]interface{}{"phrase": fallbackPhrase(seed)}
+				err = nil
+			}
+			if err == nil {
+				progress.report("phrase", phraseResult)
+			}
+			return err
+		})
+	}
+	if request.ImageURL != "" {
+		progress.report("image", imageResult)
+	} else {
+		g.Go(func() error {
+			query := url.Values{"seed": {strconv.FormatInt(pickerSeed(seed, "image"), 10)}}
+			if request.ImageTag != "" {
+				query.Set("tag", request.ImageTag)
+			}
+			err := rejection(fetchJSON(gctx, "fetchImage", imagePicker, "image", query, &imageResult))
+			if fallbacks.Image && degradable(gctx, err) {
+				degraded.add(ctx, "image", err)
+				imageResult = map[string]interface{}{"imageUrl": fallbacks.ImageURL}
+				err = nil
+			}
+			if err == nil {
+				progress.report("image", imageResult)
+			}
+			return err
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	inputs := &memeInputs{Style: request.Style, Format: request.Format, Seed: seed, degraded: degraded}
+	inputs.Phrase, _ = phraseResult["phrase"].(string)
+	inputs.ImageURL, _ = imageResult["imageUrl"].(string)
+	return inputs, nil
+}
+
+// renderMeme asks meminator to draw the phrase on the image, unless the same meme is already cached.
+// If meminator fails and the picture fallback is on, it returns the unannotated image instead.
+func renderMeme(ctx context.Context, inputs *memeInputs, progress progressFunc) (*cachedMeme, error) {
+	key := inputs.key()
+	if meme, ok := memes.Get(ctx, key); ok {
+		progress.report("rendering", map[string]interface{}{"cached": true})
+		return meme, nil
+	}
+	progress.report("rendering", map[string]interface{}{"cached": false})
+
+	renderCtx, cancel := context.WithTimeout(ctx, meminator.timeout)
+	defer cancel()
+	meminatorRequest := map[string]interface{}{
+		"phrase":   inputs.Phrase,
+		"imageUrl": inputs.ImageURL,
+	}
+	if inputs.Style != nil {
+		meminatorRequest["style"] = inputs.Style
+	}
+	if inputs.Format != "" {
+		meminatorRequest["format"] = inputs.Format
+	}
+	meminatorResponse, err := fetchFromService(renderCtx, meminator, &FetchOptions{
+		Method: "POST",
+		Body:   meminatorRequest,
+	})
+	var fetchErr *fetchError
+	if err != nil {
+		fetchErr = transportError(meminator, "Failed to fetch picture from meminator", err)
+	} else if meminatorResponse.StatusCode != http.StatusOK {
+		fetchErr = statusError(meminator, "Failed to fetch picture from meminator", meminatorResponse)
+	}
+	if fetchErr != nil {
+		if fallbacks.Picture && ctx.Err() == nil {
+			trace.SpanFromContext(ctx).RecordError(fetchErr)
+			inputs.degraded.add(ctx, "picture", fetchErr)
+			return fetchSourceImage(ctx, inputs.ImageURL)
+		}
+		return nil, fetchErr
+	}
+	defer meminatorResponse.Body.Close()
+
+	data, err := io.ReadAll(meminatorResponse.Body)
+	if err != nil {
+		return nil, transportError(meminator, "Failed to read picture from meminator", err)
+	}
+	// meminator knows what it encoded to: the source image's format, unless we asked for another.
+	contentType := meminatorResponse.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = http.DetectContentType(data)
+	}
+	meme := &cachedMeme{Key: key, ContentType: contentType, Created: time.Now(), Data: data}
+	memes.Put(meme)
+	return meme, nil
+}
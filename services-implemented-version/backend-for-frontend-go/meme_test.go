@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestPickInputsDoesNotFallBackForACancelledSibling(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	// image-picker fails outright, with its fallback off, while phrase-picker is still thinking.
+	imageServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer imageServer.Close()
+	phraseServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer phraseServer.Close()
+
+	savedFallbacks, savedImageURL, savedPhraseURL, savedRetry := fallbacks, imagePicker.url, phrasePicker.url, imagePicker.retry
+	defer func() {
+		fallbacks, imagePicker.url, phrasePicker.url, imagePicker.retry = savedFallbacks, savedImageURL, savedPhraseURL, savedRetry
+	}()
+	fallbacks.Phrase, fallbacks.Image = true, false
+	imagePicker.url, phrasePicker.url = imageServer.URL, phraseServer.URL
+	imagePicker.retry.MaxAttempts = 1
+
+	ctx, span := otel.Tracer("test").Start(context.Background(), "test")
+	seed := int64(1)
+	_, err := pickInputs(ctx, createPictureRequest{Seed: &seed}, nil)
+	span.End()
+	if err == nil {
+		t.Fatal("pickInputs succeeded without an image")
+	}
+
+	// The phrase was cancelled because the image failed, not because phrase-picker is down.
+	for _, ended := range recorder.Ended() {
+		for _, event := range ended.Events() {
+			if event.Name == "fallback" {
+				t.Errorf("span %q recorded a fallback: %v", ended.Name(), event.Attributes)
+			}
+		}
+	}
+}
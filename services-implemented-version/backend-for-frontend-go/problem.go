@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Error codes reported in problem responses.
+const (
+	codeCircuitOpen  = "circuit_open"
+	codeTimeout      = "upstream_timeout"
+	codeUnreachable  = "upstream_unreachable"
+	codeBadStatus    = "upstream_status"
+	codeDecodeFailed = "decode_error"
+	codeCanceled     = "canceled"
+	codeInvalid      = "invalid_request"
+	codeRateLimited  = "rate_limited"
+	codeInternal     = "internal_error"
+)
+
+// upstreamBodyLimit caps how much of a failed upstream response is copied into the problem.
+const upstreamBodyLimit = 1024
+
+// fetchError describes a failed call to a downstream service, in enough detail to explain it to the caller.
+type fetchError struct {
+	Title          string
+	Code           string
+	Dependency     string
+	UpstreamStatus int
+	UpstreamBody   string
+	err            error
+}
+
+func (e *fetchError) Error() string { return e.Title + ": " + e.err.Error() }
+
+func (e *fetchError) Unwrap() error { return e.err }
+
+// status is the HTTP status the BFF answers with when this call fails.
+func (e *fetchError) status() int {
+	switch e.Code {
+	case codeCircuitOpen:
+		return http.StatusServiceUnavailable
+	case codeTimeout:
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// transportError classifies an error returned by fetchFromService.
+func transportError(service *downstream, title string, err error) *fetchError {
+	fe := &fetchError{Title: title, Code: codeUnreachable, Dependency: service.name, err: err}
+	var open *breakerOpenError
+	switch {
+	case errors.As(err, &open):
+		fe.Title = open.Error()
+		fe.Code = codeCircuitOpen
+	case errors.Is(err, context.DeadlineExceeded):
+		fe.Code = codeTimeout
+	case errors.Is(err, context.Canceled):
+		fe.Code = codeCanceled
+	}
+	return fe
+}
+
+// statusError describes an unexpected upstream response, keeping the start of its body. It closes the body.
+func statusError(service *downstream, title string, resp *http.Response) *fetchError {
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, upstreamBodyLimit))
+	return &fetchError{
+		Title:          title,
+		Code:           codeBadStatus,
+		Dependency:     service.name,
+		UpstreamStatus: resp.StatusCode,
+		UpstreamBody:   string(body),
+		err:            errors.New(service.name + " responded " + resp.Status),
+	}
+}
+
+// rejection turns a 4xx from a downstream service, which refused what the client asked for,
+// into a requestError, keeping the service's own explanation. 408 and 429 are about the call
+// rather than the request, so they, like every other failure, are returned as they are.
+func rejection(err error) error {
+	var fe *fetchError
+	if !errors.As(err, &fe) || fe.UpstreamStatus < 400 || fe.UpstreamStatus >= 500 ||
+		fe.UpstreamStatus == http.StatusRequestTimeout || fe.UpstreamStatus == http.StatusTooManyRequests {
+		return err
+	}
+	var body struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal([]byte(fe.UpstreamBody), &body) == nil && body.Error != "" {
+		return &requestError{fmt.Errorf("%s: %s", fe.Dependency, body.Error)}
+	}
+	return &requestError{fe}
+}
+
+// problem is an RFC 7807 problem details document.
+type problem struct {
+	Type           string `json:"type"`
+	Title          string `json:"title"`
+	Status         int    `json:"status"`
+	Detail         string `json:"detail,omitempty"`
+	Instance       string `json:"instance,omitempty"`
+	Code           string `json:"code"`
+	Dependency     string `json:"dependency,omitempty"`
+	UpstreamStatus int    `json:"upstreamStatus,omitempty"`
+	UpstreamBody   string `json:"upstreamBody,omitempty"`
+	TraceID        string `json:"traceId,omitempty"`
+}
+
+// apiError is a failure the BFF itself decides on, with the status and code to report.
+type apiError struct {
+	Status int
+	Code   string
+	Title  string
+}
+
+func (e *apiError) Error() string { return e.Title }
+
+// newProblem describes err, and the trace it happened in, as a problem document.
+func newProblem(span trace.Span, instance string, err error) problem {
+	p := problem{
+		Title:    "Failed to create picture",
+		Status:   http.StatusInternalServerError,
+		Detail:   err.Error(),
+		Instance: instance,
+		Code:     codeInternal,
+	}
+	var fe *fetchError
+	var re *requestError
+	var rl *rateLimitError
+	var ae *apiError
+	if errors.As(err, &ae) {
+		p.Title = ae.Title
+		p.Status = ae.Status
+		p.Code = ae.Code
+	} else if errors.As(err, &rl) {
+		p.Title = "Too many requests"
+		p.Status = http.StatusTooManyRequests
+		p.Code = codeRateLimited
+	} else if errors.As(err, &re) {
+		p.Title = "Invalid request"
+		p.Status = http.StatusBadRequest
+		p.Code = codeInvalid
+	} else if errors.As(err, &fe) {
+		p.Title = fe.Title
+		p.Status = fe.status()
+		p.Code = fe.Code
+		p.Dependency = fe.Dependency
+		p.UpstreamStatus = fe.UpstreamStatus
+		p.UpstreamBody = fe.UpstreamBody
+	}
+	p.Type = "/problems/" + p.Code
+	if sc := span.SpanContext(); sc.HasTraceID() {
+		p.TraceID = sc.TraceID().String()
+	}
+	return p
+}
+
+// writeProblem records err on the active span and answers with application/problem+json.
+func writeProblem(ctx context.Context, w http.ResponseWriter, r *http.Request, err error) {
+	span := trace.SpanFromContext(ctx)
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+
+	p := newProblem(span, r.URL.Path, err)
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
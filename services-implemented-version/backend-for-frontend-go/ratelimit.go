@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
+)
+
+// rateLimitConfig sets the per-client token bucket. A Rate of zero or less turns limiting off.
+type rateLimitConfig struct {
+	Rate           float64 // tokens per second
+	Burst          int
+	TrustedProxies []netip.Prefix // take the client address from X-Forwarded-For on requests from these
+	IdleTimeout    time.Duration  // forget clients not seen for this long
+	MaxClients     int            // forget the longest idle client to make room for a new one
+}
+
+// rateLimitConfigFromEnv reads the RATE_LIMIT_* environment variables, falling back to defaults.
+func rateLimitConfigFromEnv() rateLimitConfig {
+	perSecond, err := strconv.ParseFloat(os.Getenv("RATE_LIMIT_RPS"), 64)
+	if err != nil {
+		perSecond = 2
+	}
+	return rateLimitConfig{
+		Rate:           perSecond,
+		Burst:          envInt("RATE_LIMIT_BURST", 5),
+		TrustedProxies: trustedProxiesFromEnv(),
+		IdleTimeout:    envDuration("RATE_LIMIT_IDLE_TIMEOUT", 10*time.Minute),
+		MaxClients:     envInt("RATE_LIMIT_MAX_CLIENTS", 10000),
+	}
+}
+
+// trustedProxiesFromEnv reads RATE_LIMIT_TRUSTED_PROXIES, the addresses or CIDR ranges of the
+// proxies in front of the BFF, such as the web container's nginx, separated by commas. There are
+// none by default, since the BFF's own port may be reachable directly, and anyone can send
+// X-Forwarded-For. Entries that don't parse are skipped.
+func trustedProxiesFromEnv() []netip.Prefix {
+	var proxies []netip.Prefix
+	for _, entry := range strings.Split(os.Getenv("RATE_LIMIT_TRUSTED_PROXIES"), ",") {
+		entry = strings.TrimSpace(entry)
+		if prefix, err := netip.ParsePrefix(entry); err == nil {
+			proxies = append(proxies, prefix.Masked())
+		} else if addr, err := netip.ParseAddr(entry); err == nil {
+			proxies = append(proxies, netip.PrefixFrom(addr, addr.BitLen()))
+		}
+	}
+	return proxies
+}
+
+// costContextKey carries how many tokens, and how much quota, a request takes.
+type costContextKey struct{}
+
+// withCost sets what the request costs. Requests that don't set it cost one.
+func withCost(ctx context.Context, cost int) context.Context {
+	return context.WithValue(ctx, costContextKey{}, cost)
+}
+
+func requestCost(ctx context.Context) int {
+	if cost, ok := ctx.Value(costContextKey{}).(int); ok && cost > 0 {
+		return cost
+	}
+	return 1
+}
+
+// rateLimitError is returned when a client has used up its bucket.
+type rateLimitError struct {
+	retryAfter time.Duration
+}
+
+func (e *rateLimitError) Error() string {
+	return fmt.Sprintf("rate limit exceeded, retry after %s", e.retryAfter.Round(time.Second))
+}
+
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// rateLimiter keeps a token bucket for every client it has seen recently.
+type rateLimiter struct {
+	config   rateLimitConfig
+	rejected metric.Int64Counter
+
+	mu        sync.Mutex
+	clients   map[string]*clientLimiter
+	lastSweep time.Time
+}
+
+func newRateLimiter(config rateLimitConfig) *rateLimiter {
+	l := &rateLimiter{config: config, clients: map[string]*clientLimiter{}, lastSweep: time.Now()}
+	l.rejected, _ = otel.Meter("backend-for-frontend").Int64Counter("app.rate_limit.rejected",
+		metric.WithDescription("Requests rejected by the per-client rate limiter"))
+	return l
+}
+
+// clientKey identifies who is calling: their API key once auth has accepted it, otherwise their
+// address. Any other Authorization header is ignored, so made-up keys don't get buckets of their own.
+// API keys are only ever held as hashes, so they never sit in memory or telemetry as-is.
+func (l *rateLimiter) clientKey(r *http.Request) (key string, keyType string) {
+	if keyHash, ok := authenticatedKey(r.Context()); ok {
+		return "key:" + keyHash[:16], "api_key"
+	}
+	return "ip:" + l.clientAddress(r), "ip"
+}
+
+// clientAddress is the address the request came from. When that is a trusted proxy, it is the
+// last X-Forwarded-For entry instead, the one the proxy itself appended. Earlier entries come
+// from the client and can't be trusted.
+func (l *rateLimiter) clientAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !l.trusted(host) {
+		return host
+	}
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		parts := strings.Split(forwarded, ",")
+		if address := strings.TrimSpace(parts[len(parts)-1]); address != "" {
+			return address
+		}
+	}
+	return host
+}
+
+func (l *rateLimiter) trusted(host string) bool {
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	for _, proxy := range l.config.TrustedProxies {
+		if proxy.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// allow takes n tokens from the client's bucket, or says how long until they are available. A
+// request may cost more than the burst, as a batch does: it goes ahead once a full burst is
+// available, and borrows the rest from tokens still to come, so the client waits for them later.
+func (l *rateLimiter) allow(key string, n int) (time.Duration, bool) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) > l.config.IdleTimeout {
+		l.sweep(now)
+	}
+
+	client, ok := l.clients[key]
+	if !ok {
+		if len(l.clients) >= l.config.MaxClients {
+			l.makeRoom(now)
+		}
+		client = &clientLimiter{limiter: rate.NewLimiter(rate.Limit(l.config.Rate), l.config.Burst)}
+		l.clients[key] = client
+	}
+	client.lastSeen = now
+
+	first := max(min(n, l.config.Burst), 1)
+	reservation := client.limiter.ReserveN(now, first)
+	if !reservation.OK() {
+		return time.Second, false
+	}
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now)
+		return delay, false
+	}
+	for rest := n - first; rest > 0 && l.config.Burst > 0; rest -= l.config.Burst {
+		client.limiter.ReserveN(now, min(rest, l.config.Burst))
+	}
+	return 0, true
+}
+
+// sweep forgets clients that haven't been seen for the idle timeout.
+func (l *rateLimiter) sweep(now time.Time) {
+	for k, client := range l.clients {
+		if now.Sub(client.lastSeen) > l.config.IdleTimeout {
+			delete(l.clients, k)
+		}
+	}
+	l.lastSweep = now
+}
+
+// makeRoom keeps the number of clients under the limit between sweeps. It sweeps early, and if
+// every client is still active, forgets the one that has been idle longest.
+func (l *rateLimiter) makeRoom(now time.Time) {
+	l.sweep(now)
+	for len(l.clients) >= max(l.config.MaxClients, 1) {
+		var oldest string
+		for k, client := range l.clients {
+			if oldest == "" || client.lastSeen.Before(l.clients[oldest].lastSeen) {
+				oldest = k
+			}
+		}
+		delete(l.clients, oldest)
+	}
+}
+
+// middleware rejects clients over their limit with 429 and Retry-After. It goes inside
+// otelhttp so that the decision is recorded on the server span.
+func (l *rateLimiter) middleware(next http.Handler) http.Handler {
+	if l.config.Rate <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, keyType := l.clientKey(r)
+		retryAfter, ok := l.allow(key, requestCost(r.Context()))
+
+		span := trace.SpanFromContext(r.Context())
+		span.SetAttributes(
+			attribute.Bool("app.rate_limit.limited", !ok),
+			attribute.String("app.rate_limit.key_type", keyType),
+		)
+		if keyType == "ip" {
+			span.SetAttributes(attribute.String("client.address", strings.TrimPrefix(key, "ip:")))
+		}
+		if ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		l.rejected.Add(r.Context(), 1, metric.WithAttributes(attribute.String("app.rate_limit.key_type", keyType)))
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		writeProblem(r.Context(), w, r, &rateLimitError{retryAfter: retryAfter})
+	})
+}
+
+var limiter = newRateLimiter(rateLimitConfigFromEnv())
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestClientAddress(t *testing.T) {
+	l := newRateLimiter(rateLimitConfig{
+		Rate:           1,
+		Burst:          1,
+		TrustedProxies: []netip.Prefix{netip.MustParsePrefix("172.28.0.0/16")},
+	})
+	for _, tt := range []struct {
+		name      string
+		peer      string
+		forwarded string
+		want      string
+	}{
+		{"direct", "203.0.113.7:5000", "", "203.0.113.7"},
+		{"untrusted peer can't pick its address", "203.0.113.7:5000", "198.51.100.1", "203.0.113.7"},
+		{"trusted proxy", "172.28.0.5:5000", "198.51.100.1", "198.51.100.1"},
+		{"trusted proxy, client-supplied entries ignored", "172.28.0.5:5000", "10.0.0.1, 198.51.100.1", "198.51.100.1"},
+		{"trusted proxy without the header", "172.28.0.5:5000", "", "172.28.0.5"},
+		{"trusted proxy over IPv6-mapped IPv4", "[::ffff:172.28.0.5]:5000", "198.51.100.1", "198.51.100.1"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/createPicture", nil)
+			r.RemoteAddr = tt.peer
+			if tt.forwarded != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			if got := l.clientAddress(r); got != tt.want {
+				t.Errorf("clientAddress = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimiterBurstAndRefill(t *testing.T) {
+	l := newRateLimiter(rateLimitConfig{Rate: 20, Burst: 3, IdleTimeout: time.Minute, MaxClients: 10})
+
+	for i := 0; i < 3; i++ {
+		if _, ok := l.allow("ip:a", 1); !ok {
+			t.Fatalf("request %d of the burst was refused", i)
+		}
+	}
+	wait, ok := l.allow("ip:a", 1)
+	if ok {
+		t.Fatal("a request past the burst was let through")
+	}
+	if wait <= 0 || wait > 50*time.Millisecond {
+		t.Errorf("told to wait %s, want up to one token's 50ms", wait)
+	}
+	// Other clients have buckets of their own.
+	if _, ok := l.allow("ip:b", 1); !ok {
+		t.Error("a second client was refused")
+	}
+
+	time.Sleep(wait)
+	if _, ok := l.allow("ip:a", 1); !ok {
+		t.Error("refused after waiting for the bucket to refill")
+	}
+}
+
+func TestRateLimiterChargesCost(t *testing.T) {
+	l := newRateLimiter(rateLimitConfig{Rate: 1, Burst: 5, IdleTimeout: time.Minute, MaxClients: 10})
+
+	// A batch of 8 goes through on a full bucket, and borrows 3 seconds' worth of tokens.
+	if _, ok := l.allow("ip:a", 8); !ok {
+		t.Fatal("a batch was refused on a full bucket")
+	}
+	wait, ok := l.allow("ip:a", 1)
+	if ok || wait < 3*time.Second || wait > 4*time.Second {
+		t.Errorf("allow after the batch = %s, %v, want a wait of about 4s", wait, ok)
+	}
+}
+
+func TestRateLimiterForgetsIdleClients(t *testing.T) {
+	l := newRateLimiter(rateLimitConfig{Rate: 1, Burst: 1, IdleTimeout: time.Minute, MaxClients: 2})
+	l.allow("ip:a", 1)
+	l.allow("ip:b", 1)
+	l.allow("ip:a", 1)
+	l.allow("ip:c", 1)
+	if _, ok := l.clients["ip:b"]; ok || len(l.clients) != 2 {
+		t.Errorf("clients = %v, want b, the longest idle, forgotten", l.clients)
+	}
+}
+
+func TestRateLimitMiddlewareSetsRetryAfter(t *testing.T) {
+	l := newRateLimiter(rateLimitConfig{Rate: 0.5, Burst: 1, IdleTimeout: time.Minute, MaxClients: 10})
+	handler := l.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	statuses := []int{}
+	var last *httptest.ResponseRecorder
+	for i := 0; i < 2; i++ {
+		r := httptest.NewRequest(http.MethodPost, "/createPicture", nil)
+		r.RemoteAddr = "203.0.113.7:5000"
+		last = httptest.NewRecorder()
+		handler.ServeHTTP(last, r)
+		statuses = append(statuses, last.Code)
+	}
+	if statuses[0] != http.StatusNoContent || statuses[1] != http.StatusTooManyRequests {
+		t.Fatalf("statuses = %v, want [204 429]", statuses)
+	}
+	if got := last.Header().Get("Retry-After"); got != "2" {
+		t.Errorf("Retry-After = %q, want 2", got)
+	}
+	if got := last.Header().Get("Content-Type"); got != "application/problem+json" {
+		t.Errorf("Content-Type = %q, want a problem document", got)
+	}
+}
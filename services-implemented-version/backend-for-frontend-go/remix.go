@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// remixRequest is the optional JSON body of POST /memes/{id}/remix.
+// Anything left empty is kept from the original meme.
+type remixRequest struct {
+	Phrase   string     `json:"phrase,omitempty"`
+	ImageURL string     `json:"imageUrl,omitempty"`
+	Style    *memeStyle `json:"style,omitempty"`
+	Format   string     `json:"format,omitempty"`
+}
+
+// maxChainLength stops a remix chain walk that would otherwise go on for too long.
+const maxChainLength = 50
+
+var errRemixNotSaved = &apiError{Status: http.StatusInternalServerError, Code: "storage_failed", Title: "The remix was made but could not be saved"}
+
+// remixMeme handles POST /memes/{id}/remix. It makes a new meme from a saved one, changing
+// only what the body asks for, and links its trace to the trace that made the original.
+func remixMeme(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if gallery == nil {
+		writeProblem(ctx, w, r, errGalleryDisabled)
+		return
+	}
+	var overrides remixRequest
+	decoder := json.NewDecoder(io.LimitReader(r.Body, 64*1024))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&overrides); err != nil && !errors.Is(err, io.EOF) {
+		writeProblem(ctx, w, r, &requestError{fmt.Errorf("invalid request body: %w", err)})
+		return
+	}
+
+	parent, err := gallery.LoadRecord(ctx, r.PathValue("id"))
+	if err != nil {
+		writeProblem(ctx, w, r, err)
+		return
+	}
+	request := createPictureRequest{
+		Phrase:   parent.Phrase,
+		ImageURL: parent.ImageURL,
+		Style:    parent.Style,
+		Seed:     &parent.Seed,
+		Format:   parent.Format,
+	}
+	if request.Format == "" {
+		// The parent kept its source image's format, so a new image wouldn't keep it by itself.
+		request.Format = formatOf(parent.ContentType)
+	}
+	if overrides.Format != "" {
+		request.Format = normalizeFormat(overrides.Format)
+	}
+	if overrides.Phrase != "" {
+		request.Phrase = overrides.Phrase
+	}
+	if overrides.ImageURL != "" {
+		request.ImageURL = overrides.ImageURL
+	}
+	if overrides.Style != nil {
+		request.Style = overrides.Style
+	}
+	if err := request.validate(); err != nil {
+		writeProblem(ctx, w, r, &requestError{err})
+		return
+	}
+
+	ctx, span := otel.Tracer("backend-for-frontend").Start(ctx, "remixMeme",
+		trace.WithLinks(parentLinks(parent)...),
+		trace.WithAttributes(
+			attribute.String("app.remix.parent_id", parent.ID),
+			attribute.Bool("app.remix.phrase_changed", overrides.Phrase != ""),
+			attribute.Bool("app.remix.image_changed", overrides.ImageURL != ""),
+			attribute.Bool("app.remix.style_changed", overrides.Style != nil),
+			attribute.Bool("app.remix.format_changed", overrides.Format != ""),
+		),
+	)
+	defer span.End()
+	ctx = withSeed(ctx, parent.Seed)
+
+	// Both the phrase and the image are pinned, so this doesn't call the pickers.
+	inputs, err := pickInputs(ctx, request, nil)
+	var result *cachedMeme
+	if err == nil {
+		result, err = renderMeme(ctx, inputs, nil)
+	}
+	if err != nil {
+		writeProblem(ctx, w, r, err)
+		return
+	}
+
+	record := newMemeRecord(ctx, newMemeID(), inputs)
+	record.ParentID = parent.ID
+	if !storeMeme(ctx, record, result) {
+		span.SetStatus(codes.Error, errRemixNotSaved.Title)
+		writeProblem(ctx, w, r, errRemixNotSaved)
+		return
+	}
+	record.ContentType, record.Size = result.ContentType, len(result.Data)
+	span.SetAttributes(attribute.String("app.meme.id", record.ID))
+
+	inputs.degraded.apply(w, span)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", permalink(r, record.ID))
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(galleryItem{record, permalink(r, record.ID)})
+}
+
+// parentLinks points at the span that made a meme. Memes saved without a span ID get no link.
+func parentLinks(parent memeRecord) []trace.Link {
+	traceID, _ := trace.TraceIDFromHex(parent.TraceID)
+	spanID, _ := trace.SpanIDFromHex(parent.SpanID)
+	spanContext := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID: traceID,
+		SpanID:  spanID,
+		Remote:  true,
+	})
+	if !spanContext.IsValid() {
+		return nil
+	}
+	return []trace.Link{{
+		SpanContext: spanContext,
+		Attributes: []attribute.KeyValue{
+			attribute.String("app.link", "remix_of"),
+			attribute.String("app.meme.id", parent.ID),
+		},
+	}}
+}
+
+// getRemixChain handles GET /m/{id}/chain. It lists the meme and then each meme it was
+// remixed from, back to the original.
+func getRemixChain(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if gallery == nil {
+		writeProblem(ctx, w, r, errGalleryDisabled)
+		return
+	}
+	chain, err := remixChain(ctx, r.PathValue("id"))
+	if err != nil {
+		writeProblem(ctx, w, r, err)
+		return
+	}
+	page := galleryPage{Items: []galleryItem{}}
+	for _, record := range chain {
+		page.Items = append(page.Items, galleryItem{record, permalink(r, record.ID)})
+	}
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int("app.remix.chain_length", len(chain)))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+// remixChain follows parent IDs from id. A parent that has since gone from the gallery ends the chain.
+func remixChain(ctx context.Context, id string) ([]memeRecord, error) {
+	var chain []memeRecord
+	for id != "" && len(chain) < maxChainLength {
+		record, err := gallery.LoadRecord(ctx, id)
+		if errors.Is(err, errMemeNotFound) && len(chain) > 0 {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, record)
+		id = record.ParentID
+	}
+	return chain, nil
+}
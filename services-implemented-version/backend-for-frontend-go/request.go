@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const maxPhraseLength = 200
+
+// createPictureRequest is the optional JSON body of POST /createPicture.
+// Anything left empty is chosen at random, as before.
+type createPictureRequest struct {
+	Phrase         string     `json:"phrase,omitempty"`
+	ImageURL       string     `json:"imageUrl,omitempty"`
+	PhraseCategory string     `json:"phraseCategory,omitempty"`
+	ImageTag       string     `json:"imageTag,omitempty"`
+	Style          *memeStyle `json:"style,omitempty"`
+	Seed           *int64     `json:"seed,omitempty"`
+	Format         string     `json:"format,omitempty"` // png, jpeg, webp or gif; empty keeps the source image's format
+}
+
+// memeStyle is passed through to meminator.
+type memeStyle struct {
+	FontSize int    `json:"fontSize,omitempty"`
+	Color    string `json:"color,omitempty"`
+	Position string `json:"position,omitempty"`
+}
+
+// requestError is a problem with the client's request rather than with a downstream service.
+type requestError struct {
+	err error
+}
+
+func (e *requestError) Error() string { return e.err.Error() }
+
+func (e *requestError) Unwrap() error { return e.err }
+
+var errInvalidFormat = errors.New("format must be png, jpeg, webp or gif")
+
+var colorPattern = regexp.MustCompile(`^(#[0-9a-fA-F]{3}|#[0-9a-fA-F]{6}|[a-zA-Z]{3,20})$`)
+
+// imageHosts are the only hosts a client's imageUrl may point at, since meminator downloads it from
+// inside the network.
+var imageHosts = imageHostsFromEnv()
+
+// imageHostsFromEnv reads IMAGE_HOSTS, a comma-separated list of host[:port]. By default it allows
+// the bucket image-picker's pictures are in, BUCKET_NAME, and wherever the fallback image is served.
+func imageHostsFromEnv() map[string]bool {
+	hosts := map[string]bool{}
+	list := os.Getenv("IMAGE_HOSTS")
+	if list == "" {
+		bucket := os.Getenv("BUCKET_NAME")
+		if bucket == "" {
+			bucket = "random-pictures"
+		}
+		list = bucket + ".s3.amazonaws.com"
+		if u, err := url.Parse(fallbacks.ImageURL); err == nil {
+			list += "," + u.Host
+		}
+	}
+	for _, host := range strings.Split(list, ",") {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			hosts[host] = true
+		}
+	}
+	return hosts
+}
+
+// allowedImageURL reports whether an image may be fetched from rawURL.
+func allowedImageURL(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.User != nil {
+		return false
+	}
+	return imageHosts[strings.ToLower(u.Host)]
+}
+
+// parseCreatePictureRequest reads and validates the request body. An empty body is a valid, empty request.
+func parseCreatePictureRequest(r *http.Request) (createPictureRequest, error) {
+	var req createPictureRequest
+	decoder := json.NewDecoder(io.LimitReader(r.Body, 64*1024))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		return req, &requestError{fmt.Errorf("invalid request body: %w", err)}
+	}
+	req.Format = normalizeFormat(req.Format)
+	if err := req.validate(); err != nil {
+		return req, &requestError{err}
+	}
+	return req, nil
+}
+
+// parseCreatePictureQuery reads the same fields as parseCreatePictureRequest from the query string,
+// for GET endpoints such as the event stream.
+func parseCreatePictureQuery(r *http.Request) (createPictureRequest, error) {
+	query := r.URL.Query()
+	req := createPictureRequest{
+		Phrase:         query.Get("phrase"),
+		ImageURL:       query.Get("imageUrl"),
+		PhraseCategory: query.Get("phraseCategory"),
+		ImageTag:       query.Get("imageTag"),
+		Format:         normalizeFormat(query.Get("format")),
+	}
+	if value := query.Get("seed"); value != "" {
+		seed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return req, &requestError{errors.New("seed must be an integer")}
+		}
+		req.Seed = &seed
+	}
+	if query.Has("fontSize") || query.Has("color") || query.Has("position") {
+		req.Style = &memeStyle{Color: query.Get("color"), Position: query.Get("position")}
+		if value := query.Get("fontSize"); value != "" {
+			fontSize, err := strconv.Atoi(value)
+			if err != nil {
+				return req, &requestError{errors.New("fontSize must be an integer")}
+			}
+			req.Style.FontSize = fontSize
+		}
+	}
+	if err := req.validate(); err != nil {
+		return req, &requestError{err}
+	}
+	return req, nil
+}
+
+func (req createPictureRequest) validate() error {
+	if req.Phrase != "" && req.PhraseCategory != "" {
+		return errors.New("phrase and phraseCategory can't both be set")
+	}
+	if req.ImageURL != "" && req.ImageTag != "" {
+		return errors.New("imageUrl and imageTag can't both be set")
+	}
+	if utf8.RuneCountInString(req.Phrase) > maxPhraseLength {
+		return fmt.Errorf("phrase is longer than %d characters", maxPhraseLength)
+	}
+	// ImageMagick reads the text to draw from a file when it starts with @.
+	if strings.HasPrefix(req.Phrase, "@") {
+		return errors.New("phrase must not start with @")
+	}
+	if req.ImageURL != "" && !allowedImageURL(req.ImageURL) {
+		return errors.New("imageUrl must be an http or https URL on one of the allowed image hosts")
+	}
+	if _, ok := imageFormats[req.Format]; req.Format != "" && !ok {
+		return errInvalidFormat
+	}
+	if req.Seed != nil && *req.Seed < 0 {
+		return errors.New("seed must not be negative")
+	}
+	if style := req.Style; style != nil {
+		if style.FontSize != 0 && (style.FontSize < 8 || style.FontSize > 200) {
+			return errors.New("style.fontSize must be between 8 and 200")
+		}
+		if style.Color != "" && !colorPattern.MatchString(style.Color) {
+			return errors.New("style.color must be a color name or a #rgb or #rrggbb hex value")
+		}
+		switch style.Position {
+		case "", "top", "center", "bottom":
+		default:
+			return errors.New("style.position must be top, center or bottom")
+		}
+	}
+	return nil
+}
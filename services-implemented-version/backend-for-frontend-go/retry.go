@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// retryPolicy controls how idempotent (GET) calls to a downstream service are retried.
+type retryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// retryPolicyFromEnv reads the RETRY_* environment variables, falling back to defaults.
+func retryPolicyFromEnv() retryPolicy {
+	return retryPolicy{
+		MaxAttempts: envInt("RETRY_MAX_ATTEMPTS", 3),
+		BaseDelay:   envDuration("RETRY_BASE_DELAY", 100*time.Millisecond),
+		MaxDelay:    envDuration("RETRY_MAX_DELAY", 2*time.Second),
+	}
+}
+
+// backoff returns how long to wait after the given attempt: exponential growth with full jitter.
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	delay := p.BaseDelay << (attempt - 1)
+	if delay <= 0 || delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return time.Duration(rand.Int63n(int64(delay) + 1))
+}
+
+// retryable reports whether a failed attempt is worth trying again.
+func retryable(ctx context.Context, resp *http.Response, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if err != nil {
+		// Connection resets, refused connections and similar transport errors.
+		return true
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+}
+
+// retryAfter parses a Retry-After header, given either as seconds or as an HTTP date.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp == nil {
+		return 0, false
+	}
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if when, err := http.ParseTime(value); err == nil {
+		return max(time.Until(when), 0), true
+	}
+	return 0, false
+}
+
+// doWithRetry sends req, retrying per the service's policy. Each attempt is recorded as a
+// span event on the current span, carrying the attempt number and its outcome.
+func doWithRetry(ctx context.Context, service *downstream, req *http.Request) (*http.Response, error) {
+	span := trace.SpanFromContext(ctx)
+	policy := service.retry
+
+	for attempt := 1; ; attempt++ {
+		resp, err := service.client.Do(req.Clone(ctx))
+
+		attrs := []attribute.KeyValue{
+			attribute.Int("app.attempt", attempt),
+			attribute.String("peer.service", service.name),
+		}
+		if err != nil {
+			attrs = append(attrs, attribute.String("error.message", err.Error()))
+		} else {
+			attrs = append(attrs, attribute.Int("http.response.status_code", resp.StatusCode))
+		}
+		span.AddEvent("attempt", trace.WithAttributes(attrs...))
+
+		if attempt >= policy.MaxAttempts || !retryable(ctx, resp, err) {
+			return resp, err
+		}
+
+		delay, ok := retryAfter(resp)
+		if !ok {
+			delay = policy.backoff(attempt)
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(delay).After(deadline) {
+			span.AddEvent("retry abandoned", trace.WithAttributes(
+				attribute.Int("app.attempt", attempt),
+				attribute.String("app.retry.reason", "deadline too close"),
+			))
+			return resp, err
+		}
+
+		// Release this attempt's connection before trying again.
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
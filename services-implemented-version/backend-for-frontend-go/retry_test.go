@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flakyService answers with each of statuses in turn, then with the last one for good.
+func flakyService(t *testing.T, statuses ...int) (*downstream, *atomic.Int32) {
+	t.Helper()
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(calls.Add(1))
+		w.WriteHeader(statuses[min(n, len(statuses))-1])
+	}))
+	t.Cleanup(server.Close)
+	service := newDownstream("flaky", server.URL, time.Second, transportConfig{})
+	service.retry = retryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}
+	return service, &calls
+}
+
+func get(t *testing.T, ctx context.Context, service *downstream) (int, error) {
+	t.Helper()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, service.url, nil)
+	resp, err := doWithRetry(ctx, service, req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+func TestRetryUntilSuccess(t *testing.T) {
+	service, calls := flakyService(t, http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK)
+	status, err := get(t, context.Background(), service)
+	if err != nil || status != http.StatusOK {
+		t.Fatalf("got %d, %v, want 200", status, err)
+	}
+	if n := calls.Load(); n != 3 {
+		t.Errorf("%d attempts, want 3", n)
+	}
+}
+
+func TestRetryGivesUpAfterMaxAttempts(t *testing.T) {
+	service, calls := flakyService(t, http.StatusBadGateway)
+	status, err := get(t, context.Background(), service)
+	if err != nil || status != http.StatusBadGateway {
+		t.Fatalf("got %d, %v, want the last 502", status, err)
+	}
+	if n := calls.Load(); n != 3 {
+		t.Errorf("%d attempts, want 3", n)
+	}
+}
+
+func TestRetrySkipsClientErrors(t *testing.T) {
+	service, calls := flakyService(t, http.StatusNotFound, http.StatusOK)
+	status, _ := get(t, context.Background(), service)
+	if status != http.StatusNotFound {
+		t.Errorf("status = %d, want 404", status)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("%d attempts, want 1", n)
+	}
+}
+
+func TestRetryStopsAtTheDeadline(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	service := newDownstream("busy", server.URL, time.Second, transportConfig{})
+	service.retry = retryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+
+	// The service asks for a minute, which doesn't fit in the request's second.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	status, err := get(t, ctx, service)
+	if err != nil || status != http.StatusServiceUnavailable {
+		t.Fatalf("got %d, %v, want the 503 back", status, err)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("%d attempts, want 1", n)
+	}
+}
+
+func TestBackoffStaysWithinBounds(t *testing.T) {
+	policy := retryPolicy{MaxAttempts: 10, BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	for attempt := 1; attempt <= 10; attempt++ {
+		limit := min(policy.BaseDelay<<(attempt-1), policy.MaxDelay)
+		for i := 0; i < 100; i++ {
+			if delay := policy.backoff(attempt); delay < 0 || delay > limit {
+				t.Fatalf("backoff(%d) = %s, want between 0 and %s", attempt, delay, limit)
+			}
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	for _, tt := range []struct {
+		header string
+		want   time.Duration
+		ok     bool
+	}{
+		{"", 0, false},
+		{"3", 3 * time.Second, true},
+		{"soon", 0, false},
+		{time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat), 0, true},
+	} {
+		resp := &http.Response{Header: http.Header{}}
+		if tt.header != "" {
+			resp.Header.Set("Retry-After", tt.header)
+		}
+		got, ok := retryAfter(resp)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("retryAfter(%q) = %s, %v, want %s, %v", tt.header, got, ok, tt.want, tt.ok)
+		}
+	}
+}
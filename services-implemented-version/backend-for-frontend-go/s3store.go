@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// s3Config points at any S3-compatible object store, such as MinIO.
+type s3Config struct {
+	Endpoint  string // host:port, without a scheme
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	UseSSL    bool
+}
+
+// s3ConfigFromEnv reads the S3_* environment variables, falling back to defaults.
+func s3ConfigFromEnv() s3Config {
+	config := s3Config{
+		Endpoint:  os.Getenv("S3_ENDPOINT"),
+		Bucket:    os.Getenv("S3_BUCKET"),
+		Region:    os.Getenv("S3_REGION"),
+		AccessKey: os.Getenv("S3_ACCESS_KEY"),
+		SecretKey: os.Getenv("S3_SECRET_KEY"),
+		UseSSL:    envBool("S3_USE_SSL", false),
+	}
+	if config.Bucket == "" {
+		config.Bucket = "memes"
+	}
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	return config
+}
+
+// s3Store keeps the gallery in a bucket: metadata under meta/ and pictures under images/.
+type s3Store struct {
+	client *minio.Client
+	bucket string
+}
+
+// newS3Store connects to the bucket, creating it if it doesn't exist yet.
+func newS3Store(ctx context.Context, config s3Config) (*s3Store, error) {
+	if config.Endpoint == "" {
+		return nil, fmt.Errorf("S3_ENDPOINT is not set")
+	}
+	client, err := minio.New(config.Endpoint, &minio.Options{
+		Creds:        credentials.NewStaticV4(config.AccessKey, config.SecretKey, ""),
+		Secure:       config.UseSSL,
+		Region:       config.Region,
+		BucketLookup: minio.BucketLookupPath,
+		Transport: otelhttp.NewTransport(http.DefaultTransport,
+			otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string { return "S3 " + r.Method }),
+			otelhttp.WithMetricAttributesFn(func(*http.Request) []attribute.KeyValue {
+				return []attribute.KeyValue{semconv.PeerService("s3")}
+			}),
+		),
+	})
+	if err != nil {
+		return nil, err
+	}
+	exists, err := client.BucketExists(ctx, config.Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("checking bucket %s: %w", config.Bucket, err)
+	}
+	if !exists {
+		if err := client.MakeBucket(ctx, config.Bucket, minio.MakeBucketOptions{Region: config.Region}); err != nil {
+			return nil, fmt.Errorf("creating bucket %s: %w", config.Bucket, err)
+		}
+	}
+	return &s3Store{client: client, bucket: config.Bucket}, nil
+}
+
+func metaKey(id string) string  { return "meta/" + id + ".json" }
+func imageKey(id string) string { return "images/" + id }
+
+func (s *s3Store) Save(ctx context.Context, record memeRecord, data []byte) error {
+	if !memeIDPattern.MatchString(record.ID) {
+		return fmt.Errorf("invalid meme ID %q", record.ID)
+	}
+	meta, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.PutObject(ctx, s.bucket, imageKey(record.ID), bytes.NewReader(data), int64(len(data)),
+		minio.PutObjectOptions{ContentType: record.ContentType})
+	if err != nil {
+		return err
+	}
+	// The metadata goes last: a meme without it is never listed.
+	_, err = s.client.PutObject(ctx, s.bucket, metaKey(record.ID), bytes.NewReader(meta), int64(len(meta)),
+		minio.PutObjectOptions{ContentType: "application/json"})
+	return err
+}
+
+func (s *s3Store) Load(ctx context.Context, id string) (memeRecord, []byte, error) {
+	record, err := s.LoadRecord(ctx, id)
+	if err != nil {
+		return record, nil, err
+	}
+	data, err := s.get(ctx, imageKey(id))
+	return record, data, err
+}
+
+func (s *s3Store) LoadRecord(ctx context.Context, id string) (memeRecord, error) {
+	if !memeIDPattern.MatchString(id) {
+		return memeRecord{}, errMemeNotFound
+	}
+	return s.loadRecord(ctx, id)
+}
+
+func (s *s3Store) loadRecord(ctx context.Context, id string) (memeRecord, error) {
+	var record memeRecord
+	meta, err := s.get(ctx, metaKey(id))
+	if err != nil {
+		return record, err
+	}
+	return record, json.Unmarshal(meta, &record)
+}
+
+func (s *s3Store) get(ctx context.Context, key string) ([]byte, error) {
+	object, err := s.client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close()
+	data, err := io.ReadAll(object)
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return nil, errMemeNotFound
+	}
+	return data, err
+}
+
+func (s *s3Store) List(ctx context.Context, after string, limit int) ([]memeRecord, error) {
+	// Stop the listing goroutine once we have enough.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	options := minio.ListObjectsOptions{Prefix: "meta/", MaxKeys: limit}
+	if after != "" {
+		options.StartAfter = metaKey(after)
+	}
+	records := []memeRecord{}
+	for object := range s.client.ListObjects(ctx, s.bucket, options) {
+		if object.Err != nil {
+			return nil, object.Err
+		}
+		id := strings.TrimSuffix(strings.TrimPrefix(object.Key, "meta/"), ".json")
+		record, err := s.loadRecord(ctx, id)
+		if err != nil {
+			continue
+		}
+		records = append(records, record)
+		if len(records) == limit {
+			break
+		}
+	}
+	return records, nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"hash/fnv"
+	"math/rand"
+	"strconv"
+
+	"go.opentelemetry.io/otel/baggage"
+)
+
+// maxSeed keeps generated seeds within the integers a JavaScript client can hold exactly.
+const maxSeed = 1 << 53
+
+// seedHeader returns the seed to the client, so the meme can be reproduced later.
+const seedHeader = "X-Meme-Seed"
+
+// newSeed picks a seed for a request that didn't bring one.
+func newSeed() int64 {
+	return rand.Int63n(maxSeed)
+}
+
+// pickerSeed derives the seed one picker is given from the request's seed. Each picker takes its
+// first draw from the seed it gets, so given the same seed, the phrase and image picked would go
+// together: the i-th phrase always with the i-th image.
+func pickerSeed(seed int64, picker string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(strconv.FormatInt(seed, 10) + ":" + picker))
+	return int64(h.Sum64() % maxSeed)
+}
+
+// withSeed adds the seed to the request's baggage, so every service downstream can see it.
+func withSeed(ctx context.Context, seed int64) context.Context {
+	return withBaggage(ctx, "app.seed", strconv.FormatInt(seed, 10))
+}
+
+// withBaggage sets one baggage member, leaving ctx as it was if the member isn't valid baggage.
+func withBaggage(ctx context.Context, key, value string) context.Context {
+	member, err := baggage.NewMemberRaw(key, value)
+	if err != nil {
+		return ctx
+	}
+	bag, err := baggage.FromContext(ctx).SetMember(member)
+	if err != nil {
+		return ctx
+	}
+	return baggage.ContextWithBaggage(ctx, bag)
+}
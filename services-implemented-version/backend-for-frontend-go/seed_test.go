@@ -0,0 +1,30 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestPickerSeedsAreIndependent(t *testing.T) {
+	// Pickers draw their first index from the seed they are given, as the real ones do. With
+	// seven phrases and seven images, every pair should come up, not only the seven where the
+	// indexes match.
+	pairs := map[[2]int]bool{}
+	for seed := int64(0); seed < 1000; seed++ {
+		phrase := rand.New(rand.NewSource(pickerSeed(seed, "phrase"))).Intn(7)
+		image := rand.New(rand.NewSource(pickerSeed(seed, "image"))).Intn(7)
+		pairs[[2]int{phrase, image}] = true
+	}
+	if len(pairs) != 49 {
+		t.Errorf("%d of 49 phrase and image pairs came up", len(pairs))
+	}
+
+	if pickerSeed(42, "phrase") != pickerSeed(42, "phrase") {
+		t.Error("the same seed gave a picker different seeds")
+	}
+	for _, seed := range []int64{0, 1, maxSeed - 1, -5} {
+		if s := pickerSeed(seed, "image"); s < 0 || s >= maxSeed {
+			t.Errorf("pickerSeed(%d) = %d, outside [0, maxSeed)", seed, s)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// eventStream writes Server-Sent Events. Progress arrives from concurrent fetches, so writes are serialized.
+type eventStream struct {
+	mu      sync.Mutex
+	w       http.ResponseWriter
+	flusher http.Flusher
+	span    trace.Span
+	traceID string
+}
+
+// send writes one event. Every event carries the trace ID, so the browser can link to the trace.
+func (s *eventStream) send(event string, data map[string]interface{}) {
+	payload := map[string]interface{}{"traceId": s.traceID}
+	for k, v := range data {
+		payload[k] = v
+	}
+	encoded, err := json.Marshal(payload)
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", event, encoded)
+	s.flusher.Flush()
+	s.span.AddEvent("sse "+event, trace.WithAttributes(attribute.String("app.sse.event", event)))
+}
+
+// createPictureStream handles GET /createPicture/stream. It makes a meme like /createPicture,
+// takes its options from the query string, and reports each stage as it finishes:
+// phrase, image, rendering, then done with a URL for the picture, or error.
+func createPictureStream(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer("backend-for-frontend").Start(r.Context(), "createPictureStream")
+	defer span.End()
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeProblem(ctx, w, r, &apiError{Status: http.StatusInternalServerError, Code: codeInternal, Title: "Streaming is not supported"})
+		return
+	}
+	request, err := parseCreatePictureQuery(r)
+	if err != nil {
+		writeProblem(ctx, w, r, err)
+		return
+	}
+	ctx = request.ensureSeed(ctx)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // stop nginx from holding events back
+	w.Header().Set(seedHeader, strconv.FormatInt(*request.Seed, 10))
+	w.WriteHeader(http.StatusOK)
+
+	stream := &eventStream{w: w, flusher: flusher, span: span, traceID: span.SpanContext().TraceID().String()}
+	fail := func(err error) {
+		p := newProblem(span, r.URL.Path, err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		stream.send("error", map[string]interface{}{"problem": p})
+	}
+
+	inputs, err := pickInputs(ctx, request, stream.send)
+	if err != nil {
+		fail(err)
+		return
+	}
+	result, err := renderMeme(ctx, inputs, stream.send)
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	job := jobs.record(ctx, request, inputs, result)
+	if degraded := inputs.degraded.String(); degraded != "" {
+		span.SetAttributes(attribute.String("app.degraded", degraded))
+	}
+	stream.send("done", map[string]interface{}{
+		"id":       job.id,
+		"url":      job.imageURL(r),
+		"seed":     *request.Seed,
+		"degraded": inputs.degraded.list(),
+	})
+}
@@ -2,20 +2,24 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
-	"math/rand"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"go.opentelemetry.io/contrib/instrumentation/github.com/labstack/echo/otelecho"
 	"go.opentelemetry.io/otel"
-	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
-	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
-	"go.opentelemetry.io/otel/propagation"
-	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+
+	"telemetry"
+	"telemetry/echotelemetry"
 )
 
 // filename holds the collection of image files to choose from
@@ -73,6 +77,53 @@ var filenames = []string{
 	"yellow-lines.JPG",
 }
 
+// imageTags groups some of the images so callers can ask for a particular kind
+var imageTags = map[string][]string{
+	"animals": {
+		"baby-geese.jpg",
+		"cat-glowing-eyes.JPG",
+		"cat-on-leash.JPG",
+		"cat.jpg",
+		"cow-peeking.jpg",
+		"different-animals-01.png",
+		"horse-maybe.png",
+		"tanuki.png",
+		"walrus-painting.jpg",
+	},
+	"cats": {
+		"cat-glowing-eyes.JPG",
+		"cat-on-leash.JPG",
+		"cat.jpg",
+	},
+	"food": {
+		"angry-lemon-ufo.JPG",
+		"bbq.jpg",
+		"clementine.png",
+		"fine-food.jpg",
+		"lime-on-soap-dispenser.jpg",
+		"salt-packets-in-jar.jpg",
+		"square-leaf-with-nuts.jpg",
+	},
+	"honeycomb": {
+		"everything-is-an-experiment.png",
+		"experiment.png",
+		"honeycomb-dogfood-logo.png",
+		"three-pillars-2.png",
+	},
+	"outdoors": {
+		"beach.JPG",
+		"busted-light.jpg",
+		"flower.jpg",
+		"grass-and-desert-guy.png",
+		"tennessee-sunset.JPG",
+		"yellow-lines.JPG",
+	},
+}
+
+// picks counts how often each image is chosen. The tag is empty when none was asked for.
+var picks, _ = otel.Meter("image-picker").Int64Counter("app.image.picks",
+	metric.WithDescription("Images handed out, by image URL and tag"))
+
 // ImageUrl is a struct to map the JSON output
 type ImageUrl struct {
 	ImageUrl string `json:"imageUrl"`
@@ -80,6 +131,7 @@ type ImageUrl struct {
 
 var bucketName string
 var imageUrls []string
+var taggedImageUrls = map[string][]string{}
 
 // init is special function that gets called before main
 func init() {
@@ -90,27 +142,42 @@ func init() {
 	}
 
 	for _, filename := range filenames {
-		url := fmt.Sprintf("https://%s.s3.amazonaws.com/%s", bucketName, filename)
-		imageUrls = append(imageUrls, url)
+		imageUrls = append(imageUrls, imageUrl(filename))
+	}
+	for tag, tagged := range imageTags {
+		for _, filename := range tagged {
+			taggedImageUrls[tag] = append(taggedImageUrls[tag], imageUrl(filename))
+		}
 	}
 }
 
+func imageUrl(filename string) string {
+	return fmt.Sprintf("https://%s.s3.amazonaws.com/%s", bucketName, filename)
+}
+
 func main() {
-	// Initialize OpenTelemetry Tracer
-	tp, err := initTracer()
+	// Stop on Ctrl-C or docker stop, so telemetry still buffered gets sent
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Send traces, metrics and logs as the OTEL_* environment variables say
+	shutdownTelemetry, err := telemetry.Start(ctx, "image-picker")
 	if err != nil {
-		log.Fatalf("failed to initialize tracer: %v", err)
+		slog.Error("failed to start telemetry", "error", err)
+		os.Exit(1)
 	}
-	defer func() { _ = tp.Shutdown(context.Background()) }()
+	defer func() { _ = shutdownTelemetry(context.Background()) }()
 
 	// create a new echo instance
 	e := echo.New()
 
 	// Use the OpenTelemetry Echo Middleware
 	e.Use(otelecho.Middleware("image-picker"))
+	// and record the HTTP server metrics it doesn't
+	e.Use(echotelemetry.Middleware())
 
 	// Middleware
-	e.Use(middleware.Logger())
+	e.Use(echotelemetry.RequestLogger())
 	e.Use(middleware.Recover())
 
 	// Health check endpoint
@@ -120,14 +187,43 @@ func main() {
 	e.GET("/imageUrl", imageUrlHandler)
 
 	// start the server on the specified port
-	e.Logger.Fatal(e.Start(":10116"))
+	go func() {
+		if err := e.Start(":10116"); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("failed to start server", "error", err)
+			os.Exit(1)
+		}
+	}()
+	<-ctx.Done()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := e.Shutdown(shutdownCtx); err != nil {
+		slog.Error("failed to stop server", "error", err)
+	}
 }
 
 func imageUrlHandler(c echo.Context) error {
+	// narrow the choice to one tag, if asked
+	urls := imageUrls
+	tag := c.QueryParam("tag")
+	if tag != "" {
+		var ok bool
+		if urls, ok = taggedImageUrls[tag]; !ok {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": fmt.Sprintf("Unknown image tag %q", tag)})
+		}
+	}
 
-	// select a random image url
-	randomIndex := rand.Intn(len(imageUrls))
-	selectedUrl := imageUrls[randomIndex]
+	// select a random image url, reproducibly if given a seed
+	intn, err := echotelemetry.SeededIntn(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	randomIndex := intn(len(urls))
+	selectedUrl := urls[randomIndex]
+	picks.Add(c.Request().Context(), 1, metric.WithAttributes(
+		attribute.String("app.image_url", selectedUrl),
+		attribute.String("app.image.tag", tag),
+	))
 
 	// create a image url struct with the selected image url
 	response := ImageUrl{ImageUrl: selectedUrl}
@@ -139,32 +235,3 @@ func imageUrlHandler(c echo.Context) error {
 func healthCheckHandler(c echo.Context) error {
 	return c.JSON(http.StatusOK, map[string]string{"status": "healthy"})
 }
-
-func initTracer() (*sdktrace.TracerProvider, error) {
-
-	ctx := context.Background()
-	// Configure a new OTLP exporter using environment variables for sending data to Honeycomb over gRPC
-	client := otlptracehttp.NewClient()
-	exp, err := otlptrace.New(ctx, client)
-	if err != nil {
-		log.Fatalf("failed to initialize exporter: %e", err)
-	}
-
-	// Create a new trace provider with the exporter
-	tp := sdktrace.NewTracerProvider(
-		sdktrace.WithBatcher(exp),
-	)
-
-	// Register the trace provider as the global provider
-	otel.SetTracerProvider(tp)
-
-	// Register the W3C trace context and baggage propagators so data is propagated across services/processes
-	otel.SetTextMapPropagator(
-		propagation.NewCompositeTextMapPropagator(
-			propagation.TraceContext{},
-			propagation.Baggage{},
-		),
-	)
-
-	return tp, nil
-}
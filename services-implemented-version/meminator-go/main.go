@@ -2,24 +2,33 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"go.opentelemetry.io/contrib/instrumentation/github.com/labstack/echo/otelecho"
 	"go.opentelemetry.io/otel"
-	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
-	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
-	"go.opentelemetry.io/otel/propagation"
-	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+
+	"telemetry"
+	"telemetry/echotelemetry"
 )
 
 const (
@@ -35,24 +44,110 @@ type Response struct {
 type Request struct {
 	Phrase   string `json:"phrase"`
 	ImageURL string `json:"imageUrl"`
+	Style    *Style `json:"style"`
+	Format   string `json:"format"`
+}
+
+// Style tweaks how the phrase is drawn. Empty fields keep the defaults.
+type Style struct {
+	FontSize int    `json:"fontSize"`
+	Color    string `json:"color"`
+	Position string `json:"position"`
+}
+
+// gravities maps style positions to ImageMagick gravity settings
+var gravities = map[string]string{
+	"top":    "North",
+	"center": "Center",
+	"bottom": "South",
+}
+
+// formats maps the output formats we encode to onto their file extensions and content types.
+// Without a format, the output keeps the source image's format.
+var formats = map[string]struct{ extension, contentType string }{
+	"png":  {".png", "image/png"},
+	"jpeg": {".jpg", "image/jpeg"},
+	"webp": {".webp", "image/webp"},
+	"gif":  {".gif", "image/gif"},
+}
+
+// The two slow steps of making a meme, timed in milliseconds.
+var (
+	meter               = otel.Meter("meminator")
+	downloadDuration, _ = meter.Float64Histogram("app.download.duration",
+		metric.WithUnit("ms"),
+		metric.WithDescription("Time taken to download the source image"))
+	convertDuration, _ = meter.Float64Histogram("app.convert.duration",
+		metric.WithUnit("ms"),
+		metric.WithDescription("Time taken by ImageMagick to draw the phrase on the image"))
+)
+
+var colorPattern = regexp.MustCompile(`^(#[0-9a-fA-F]{3}|#[0-9a-fA-F]{6}|[a-zA-Z]{3,20})$`)
+
+// imageHosts are the only hosts we download pictures from, so a request can't make us fetch
+// something else inside the network. IMAGE_HOSTS replaces the defaults, the picture bucket
+// and the backend-for-frontend's fallback image, with a comma-separated list of host[:port].
+var imageHosts = imageHostsFromEnv()
+
+func imageHostsFromEnv() map[string]bool {
+	list := os.Getenv("IMAGE_HOSTS")
+	if list == "" {
+		bucket := os.Getenv("BUCKET_NAME")
+		if bucket == "" {
+			bucket = "random-pictures"
+		}
+		list = bucket + ".s3.amazonaws.com,backend-for-frontend:10115"
+	}
+	hosts := map[string]bool{}
+	for _, host := range strings.Split(list, ",") {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			hosts[host] = true
+		}
+	}
+	return hosts
+}
+
+func allowedImageURL(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.User != nil {
+		return false
+	}
+	return imageHosts[strings.ToLower(u.Host)]
+}
+
+// imageClient downloads pictures, following redirects only to the allowed hosts.
+var imageClient = &http.Client{
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 10 || !allowedImageURL(req.URL.String()) {
+			return http.ErrUseLastResponse
+		}
+		return nil
+	},
 }
 
 func main() {
-	// Initialize OpenTelemetry Tracer
-	tracerProvider, err := initTracer()
+	// Stop on Ctrl-C or docker stop, so telemetry still buffered gets sent
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Send traces, metrics and logs as the OTEL_* environment variables say
+	shutdownTelemetry, err := telemetry.Start(ctx, "meminator")
 	if err != nil {
-		log.Fatalf("failed to initialize tracer: %v", err)
+		slog.Error("failed to start telemetry", "error", err)
+		os.Exit(1)
 	}
-	defer func() { _ = tracerProvider.Shutdown(context.Background()) }()
+	defer func() { _ = shutdownTelemetry(context.Background()) }()
 
 	// create a new echo instance
 	e := echo.New()
 
 	// Use the OpenTelemetry Echo Middleware
 	e.Use(otelecho.Middleware("meminator"))
+	// and record the HTTP server metrics it doesn't
+	e.Use(echotelemetry.Middleware())
 
 	// Middleware
-	e.Use(middleware.Logger())
+	e.Use(echotelemetry.RequestLogger())
 	e.Use(middleware.Recover())
 
 	// Health check endpoint
@@ -62,7 +157,19 @@ func main() {
 	e.POST("/applyPhraseToPicture", meminateHandler)
 
 	// start the server on the specified port
-	e.Logger.Fatal(e.Start(":10117"))
+	go func() {
+		if err := e.Start(":10117"); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("failed to start server", "error", err)
+			os.Exit(1)
+		}
+	}()
+	<-ctx.Done()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := e.Shutdown(shutdownCtx); err != nil {
+		slog.Error("failed to stop server", "error", err)
+	}
 }
 
 func meminateHandler(c echo.Context) error {
@@ -71,6 +178,31 @@ func meminateHandler(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload"})
 	}
 
+	// the style ends up on the convert command line, so only accept known-safe values
+	if style := req.Style; style != nil {
+		if _, ok := gravities[style.Position]; style.Position != "" && !ok {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid style position"})
+		}
+		if style.FontSize != 0 && (style.FontSize < 8 || style.FontSize > 200) {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid style font size"})
+		}
+		if style.Color != "" && !colorPattern.MatchString(style.Color) {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid style color"})
+		}
+	}
+
+	if _, ok := formats[req.Format]; req.Format != "" && !ok {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid format"})
+	}
+
+	// convert reads the text from a file when it starts with @
+	if strings.HasPrefix(req.Phrase, "@") {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid phrase"})
+	}
+	if !allowedImageURL(req.ImageURL) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid image URL"})
+	}
+
 	phrase := ""
 	if req.Phrase != "" {
 		phrase = req.Phrase
@@ -80,39 +212,79 @@ func meminateHandler(c echo.Context) error {
 		imageURL = req.ImageURL
 	}
 
+	ctx := c.Request().Context()
+	downloadStart := time.Now()
 	inputImagePath, err := downloadImage(imageURL)
+	downloadDuration.Record(ctx, millisecondsSince(downloadStart), metric.WithAttributes(outcome(err)))
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to download image"})
 	}
 	defer os.Remove(inputImagePath)
 
+	gravity, pointsize, fill := "North", 48, "white"
+	if style := req.Style; style != nil {
+		if style.Position != "" {
+			gravity = gravities[style.Position]
+		}
+		if style.FontSize != 0 {
+			pointsize = style.FontSize
+		}
+		if style.Color != "" {
+			fill = style.Color
+		}
+	}
+
+	// convert picks the output format from the extension
 	outputImagePath := generateRandomFilename(inputImagePath)
+	if format, ok := formats[req.Format]; ok {
+		outputImagePath = strings.TrimSuffix(outputImagePath, getFileExtension(outputImagePath)) + format.extension
+		c.Response().Header().Set(echo.HeaderContentType, format.contentType)
+	}
 
 	cmd := exec.Command("convert",
 		inputImagePath,
 		"-resize", fmt.Sprintf("%dx%d>", imageMaxWidthPx, imageMaxHeightPx),
-		"-gravity", "North",
-		"-pointsize", "48",
-		"-fill", "white",
+		"-gravity", gravity,
+		"-pointsize", strconv.Itoa(pointsize),
+		"-fill", fill,
 		"-undercolor", "#00000080",
 		"-font", "Angkor-Regular",
 		"-annotate", "0", phrase,
 		outputImagePath)
 
-	if err := cmd.Run(); err != nil {
+	convertStart := time.Now()
+	err = cmd.Run()
+	convertDuration.Record(ctx, millisecondsSince(convertStart), metric.WithAttributes(
+		outcome(err),
+		attribute.String("app.output.format", req.Format),
+	))
+	if err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("Subprocess failed with return code: %v", err)})
 	}
 
 	defer os.Remove(outputImagePath)
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("app.output.format", req.Format))
 	return c.File(outputImagePath)
 }
 
+func millisecondsSince(start time.Time) float64 {
+	return float64(time.Since(start)) / float64(time.Millisecond)
+}
+
+// outcome says whether a step worked, for the duration metrics.
+func outcome(err error) attribute.KeyValue {
+	if err != nil {
+		return attribute.String("app.outcome", "error")
+	}
+	return attribute.String("app.outcome", "ok")
+}
+
 func healthCheckHandler(c echo.Context) error {
 	return c.JSON(http.StatusOK, map[string]string{"status": "healthy"})
 }
 
 func downloadImage(url string) (string, error) {
-	resp, err := http.Get(url)
+	resp, err := imageClient.Get(url)
 	if err != nil {
 		return "", err
 	}
@@ -162,32 +334,3 @@ func getFileExtension(url string) string {
 	}
 	return ""
 }
-
-func initTracer() (*sdktrace.TracerProvider, error) {
-
-	ctx := context.Background()
-	// Configure a new OTLP exporter using environment variables for sending data to Honeycomb over gRPC
-	client := otlptracehttp.NewClient()
-	exp, err := otlptrace.New(ctx, client)
-	if err != nil {
-		log.Fatalf("failed to initialize exporter: %e", err)
-	}
-
-	// Create a new trace provider with the exporter
-	tp := sdktrace.NewTracerProvider(
-		sdktrace.WithBatcher(exp),
-	)
-
-	// Register the trace provider as the global provider
-	otel.SetTracerProvider(tp)
-
-	// Register the W3C trace context and baggage propagators so data is propagated across services/processes
-	otel.SetTextMapPropagator(
-		propagation.NewCompositeTextMapPropagator(
-			propagation.TraceContext{},
-			propagation.Baggage{},
-		),
-	)
-
-	return tp, nil
-}
@@ -2,18 +2,24 @@ package main
 
 import (
 	"context"
-	"log"
-	"math/rand"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"go.opentelemetry.io/contrib/instrumentation/github.com/labstack/echo/otelecho"
 	"go.opentelemetry.io/otel"
-	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
-	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
-	"go.opentelemetry.io/otel/propagation"
-	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+
+	"telemetry"
+	"telemetry/echotelemetry"
 )
 
 // phrasesList holds the collection of phrases to choose from
@@ -40,27 +46,70 @@ var phrasesList = []string{
 	"who broke the build?",
 }
 
+// phraseCategories groups phrases so callers can ask for a particular kind
+var phraseCategories = map[string][]string{
+	"ops": {
+		"not dead yet",
+		"SRE not-sorry",
+		"There is no cloud",
+		"This is fine",
+		"have you tried restarting?",
+		"deploy != release",
+		"test in prod",
+	},
+	"dev": {
+		"It's a trap!",
+		"You had one job",
+		"oh, just the crimes",
+		"not a bug, it's a feature",
+		"who broke the build?",
+	},
+	"meetings": {
+		"you're muted",
+		"Let them.",
+		"Must we?",
+		"Not Today",
+		"bruh",
+		"try again after coffee",
+	},
+	"honeycomb": {
+		"Boiling Loves Company!",
+		"Honeycomb at home",
+	},
+}
+
+// picks counts how often each phrase is chosen. The category is empty when none was asked for.
+var picks, _ = otel.Meter("phrase-picker").Int64Counter("app.phrase.picks",
+	metric.WithDescription("Phrases handed out, by phrase and category"))
+
 // Phrase is a struct to map the JSON output
 type Phrase struct {
 	Phrase string `json:"phrase"`
 }
 
 func main() {
-	// Initialize OpenTelemetry Tracer
-	tracerProvider, err := initTracer()
+	// Stop on Ctrl-C or docker stop, so telemetry still buffered gets sent
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Send traces, metrics and logs as the OTEL_* environment variables say
+	shutdownTelemetry, err := telemetry.Start(ctx, "phrase-picker")
 	if err != nil {
-		log.Fatalf("failed to initialize tracer: %v", err)
+		slog.Error("failed to start telemetry", "error", err)
+		os.Exit(1)
 	}
-	defer func() { _ = tracerProvider.Shutdown(context.Background()) }()
+	defer func() { _ = shutdownTelemetry(context.Background()) }()
 
 	// create a new echo instance
 	e := echo.New()
 
 	// Use the OpenTelemetry Echo Middleware
 	e.Use(otelecho.Middleware("phrase-picker"))
+	// and record the HTTP server metrics it doesn't
+	e.Use(echotelemetry.Middleware())
 
 	// Middleware
-	e.Use(middleware.Logger())
+	e.Use(echotelemetry.RequestLogger())
 	e.Use(middleware.Recover())
 
 	// Health check endpoint
@@ -70,13 +119,43 @@ func main() {
 	e.GET("/phrase", phraseHandler)
 
 	// start the server on the specified port
-	e.Logger.Fatal(e.Start(":10118"))
+	go func() {
+		if err := e.Start(":10118"); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("failed to start server", "error", err)
+			os.Exit(1)
+		}
+	}()
+	<-ctx.Done()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := e.Shutdown(shutdownCtx); err != nil {
+		slog.Error("failed to stop server", "error", err)
+	}
 }
 
 func phraseHandler(c echo.Context) error {
-	// select a random phrase
-	randomIndex := rand.Intn(len(phrasesList))
-	selectedPhrase := phrasesList[randomIndex]
+	// narrow the choice to one category, if asked
+	phrases := phrasesList
+	category := c.QueryParam("category")
+	if category != "" {
+		var ok bool
+		if phrases, ok = phraseCategories[category]; !ok {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": fmt.Sprintf("Unknown phrase category %q", category)})
+		}
+	}
+
+	// select a random phrase, reproducibly if given a seed
+	intn, err := echotelemetry.SeededIntn(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	randomIndex := intn(len(phrases))
+	selectedPhrase := phrases[randomIndex]
+	picks.Add(c.Request().Context(), 1, metric.WithAttributes(
+		attribute.String("app.phrase", selectedPhrase),
+		attribute.String("app.phrase.category", category),
+	))
 
 	// create a Phrase struct with the selected phrase
 	response := Phrase{Phrase: selectedPhrase}
@@ -88,32 +167,3 @@ func phraseHandler(c echo.Context) error {
 func healthCheckHandler(c echo.Context) error {
 	return c.JSON(http.StatusOK, map[string]string{"status": "healthy"})
 }
-
-func initTracer() (*sdktrace.TracerProvider, error) {
-
-	ctx := context.Background()
-	// Configure a new OTLP exporter using environment variables for sending data to Honeycomb over gRPC
-	client := otlptracehttp.NewClient()
-	exp, err := otlptrace.New(ctx, client)
-	if err != nil {
-		log.Fatalf("failed to initialize exporter: %e", err)
-	}
-
-	// Create a new trace provider with the exporter
-	tp := sdktrace.NewTracerProvider(
-		sdktrace.WithBatcher(exp),
-	)
-
-	// Register the trace provider as the global provider
-	otel.SetTracerProvider(tp)
-
-	// Register the W3C trace context and baggage propagators so data is propagated across services/processes
-	otel.SetTextMapPropagator(
-		propagation.NewCompositeTextMapPropagator(
-			propagation.TraceContext{},
-			propagation.Baggage{},
-		),
-	)
-
-	return tp, nil
-}
@@ -0,0 +1,61 @@
+// Package echotelemetry records for echo servers the HTTP metrics otelhttp records for net/http
+// ones, which otelecho leaves out: request durations and sizes, by route, and requests in flight.
+// It also logs requests through slog, so that each line can be traced back to its span, and
+// gives the pickers their seeded random choices.
+package echotelemetry
+
+import (
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/metric"
+	semconv "go.opentelemetry.io/otel/semconv/v1.20.0"
+
+	"telemetry"
+)
+
+// Middleware records http.server.duration, http.server.request.size and
+// http.server.response.size, as otelhttp does, and counts requests in flight. Use it after
+// otelecho, so that the metrics are recorded inside the server span.
+func Middleware() echo.MiddlewareFunc {
+	meter := otel.Meter("telemetry/echotelemetry")
+	duration, _ := meter.Float64Histogram("http.server.duration",
+		metric.WithUnit("ms"),
+		metric.WithDescription("Measures the duration of inbound HTTP requests."))
+	requestSize, _ := meter.Int64Counter("http.server.request.size",
+		metric.WithUnit("By"),
+		metric.WithDescription("Measures the size of HTTP request messages."))
+	responseSize, _ := meter.Int64Counter("http.server.response.size",
+		metric.WithUnit("By"),
+		metric.WithDescription("Measures the size of HTTP response messages."))
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		inFlight := echo.WrapMiddleware(telemetry.ActiveRequests)(next)
+		return func(c echo.Context) error {
+			start := time.Now()
+			err := inFlight(c)
+			if err != nil {
+				// Let the error handler write the response, so its status is the one recorded.
+				c.Error(err)
+			}
+
+			request := c.Request()
+			attributes := telemetry.RequestAttributes(request)
+			if route := c.Path(); route != "" {
+				attributes = append(attributes, semconv.HTTPRoute(route))
+			}
+			if status := c.Response().Status; status > 0 {
+				attributes = append(attributes, semconv.HTTPStatusCode(status))
+			}
+			ctx := request.Context()
+			options := metric.WithAttributes(attributes...)
+			duration.Record(ctx, float64(time.Since(start))/float64(time.Millisecond), options)
+			if request.ContentLength > 0 {
+				requestSize.Add(ctx, request.ContentLength, options)
+			}
+			responseSize.Add(ctx, c.Response().Size, options)
+			return err
+		}
+	}
+}
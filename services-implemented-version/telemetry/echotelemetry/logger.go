@@ -0,0 +1,46 @@
+package echotelemetry
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// RequestLogger logs each request through slog, in place of echo's middleware.Logger. Use it
+// after otelecho, so that each line carries the trace and span IDs of the request's span.
+// Server errors are logged at error level.
+func RequestLogger() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			start := time.Now()
+			err := next(c)
+			if err != nil {
+				// Let the error handler write the response, so its status is the one logged.
+				c.Error(err)
+			}
+
+			request, response := c.Request(), c.Response()
+			attrs := []slog.Attr{
+				slog.String("method", request.Method),
+				slog.String("uri", request.RequestURI),
+				slog.String("route", c.Path()),
+				slog.Int("status", response.Status),
+				slog.Duration("latency", time.Since(start)),
+				slog.String("remote_ip", c.RealIP()),
+				slog.String("user_agent", request.UserAgent()),
+				slog.Int64("bytes_in", request.ContentLength),
+				slog.Int64("bytes_out", response.Size),
+			}
+			level := slog.LevelInfo
+			if err != nil {
+				attrs = append(attrs, slog.String("error", err.Error()))
+			}
+			if response.Status >= 500 {
+				level = slog.LevelError
+			}
+			slog.LogAttrs(request.Context(), level, "request", attrs...)
+			return err
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package echotelemetry
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// SeededIntn returns a source of random indexes for a picker. With a seed query parameter, the
+// same seed always gives the same choice, and is recorded on the span as app.seed; without one,
+// it uses the shared random source.
+func SeededIntn(c echo.Context) (func(int) int, error) {
+	seedParam := c.QueryParam("seed")
+	if seedParam == "" {
+		return rand.Intn, nil
+	}
+	seed, err := strconv.ParseInt(seedParam, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid seed %q", seedParam)
+	}
+	trace.SpanFromContext(c.Request().Context()).SetAttributes(attribute.Int64("app.seed", seed))
+	return rand.New(rand.NewSource(seed)).Intn, nil
+}
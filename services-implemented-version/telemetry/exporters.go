@@ -0,0 +1,247 @@
+package telemetry
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.opentelemetry.io/otel/exporters/otlp/otlplog/otlploggrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlplog/otlploghttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdoutlog"
+	"go.opentelemetry.io/otel/exporters/stdout/stdoutmetric"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	sdklog "go.opentelemetry.io/otel/sdk/log"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// Where a signal can go, as named in OTEL_TRACES_EXPORTER, OTEL_METRICS_EXPORTER and
+// OTEL_LOGS_EXPORTER.
+const (
+	exporterOTLP    = "otlp"
+	exporterConsole = "console" // pretty-printed JSON on stderr, leaving stdout to the log lines
+	exporterFile    = "file"    // one JSON object per line, to read offline
+	exporterNone    = "none"
+
+	exporterPrometheus = "prometheus" // metrics only, served for scraping
+)
+
+const (
+	protocolHTTP = "http/protobuf"
+	protocolGRPC = "grpc"
+)
+
+// exporterChoice is where one signal goes.
+type exporterChoice struct {
+	signal   string // traces, metrics or logs
+	kind     string
+	protocol string      // for otlp
+	path     string      // for file
+	spool    spoolConfig // for otlp traces
+
+	// prometheus is the address to serve /metrics on, if metrics go to Prometheus too.
+	prometheus string
+
+	// defaulted is set when OTLP goes to the default local endpoint, because none was configured.
+	defaulted bool
+	file      *os.File
+}
+
+// chooseExporter reads the exporter for signal from OTEL_<SIGNAL>_EXPORTER. Metrics may also
+// list prometheus, to be served for scraping; see prometheusAddress. Left unset, it is otlp, as
+// the specification has it, sending to a collector on localhost unless an OTLP endpoint is
+// configured. The OTLP protocol comes from
+// OTEL_EXPORTER_OTLP_<SIGNAL>_PROTOCOL or OTEL_EXPORTER_OTLP_PROTOCOL. Files are written to
+// OTEL_EXPORTER_FILE_DIR, the working directory by default, as <service>-<signal>.jsonl.
+// Spans sent over OTLP are spooled to disk while the endpoint can't be reached; see spoolConfigFromEnv.
+func chooseExporter(serviceName, signal string) (*exporterChoice, error) {
+	upper := strings.ToUpper(signal)
+	choice := &exporterChoice{signal: signal}
+
+	// Metrics can go to Prometheus as well as to one of the others, as in otlp,prometheus.
+	variable := "OTEL_" + upper + "_EXPORTER"
+	value := os.Getenv(variable)
+	var kinds []string
+	for _, kind := range strings.Split(value, ",") {
+		kind = strings.ToLower(strings.TrimSpace(kind))
+		switch {
+		case kind == "":
+		case kind == exporterPrometheus && signal == "metrics":
+			choice.prometheus = prometheusAddress()
+		default:
+			kinds = append(kinds, kind)
+		}
+	}
+	switch {
+	case len(kinds) > 1:
+		return nil, fmt.Errorf("%s=%q: choose one of otlp, console, file or none", variable, value)
+	case len(kinds) == 1:
+		choice.kind = kinds[0]
+	case choice.prometheus != "":
+		choice.kind = exporterNone
+	}
+	switch choice.kind {
+	case "":
+		choice.kind = exporterOTLP
+		choice.defaulted = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_"+upper+"_ENDPOINT") == ""
+	case "stdout":
+		choice.kind = exporterConsole
+	case exporterOTLP, exporterConsole, exporterFile, exporterNone:
+	default:
+		return nil, fmt.Errorf("%s=%q: want otlp, console, file or none", variable, choice.kind)
+	}
+
+	switch choice.kind {
+	case exporterOTLP:
+		variable = "OTEL_EXPORTER_OTLP_" + upper + "_PROTOCOL"
+		choice.protocol = os.Getenv(variable)
+		if choice.protocol == "" {
+			variable = "OTEL_EXPORTER_OTLP_PROTOCOL"
+			choice.protocol = os.Getenv(variable)
+		}
+		switch choice.protocol {
+		case "":
+			choice.protocol = protocolHTTP
+		case protocolHTTP, protocolGRPC:
+		default:
+			return nil, fmt.Errorf("%s=%q: want http/protobuf or grpc", variable, choice.protocol)
+		}
+		if signal == "traces" {
+			spool, err := spoolConfigFromEnv(serviceName)
+			if err != nil {
+				return nil, err
+			}
+			choice.spool = spool
+		}
+	case exporterFile:
+		dir := os.Getenv("OTEL_EXPORTER_FILE_DIR")
+		if dir == "" {
+			dir = "."
+		}
+		choice.path = filepath.Join(dir, serviceName+"-"+signal+".jsonl")
+	}
+	return choice, nil
+}
+
+// writer opens the file a signal is written to, adding to what is already there.
+func (c *exporterChoice) writer() (io.Writer, error) {
+	file, err := os.OpenFile(c.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	c.file = file
+	return file, nil
+}
+
+// close closes the file, if there is one. Call it after the provider writing to it has shut down.
+func (c *exporterChoice) close(context.Context) error {
+	if c.file == nil {
+		return nil
+	}
+	err := c.file.Close()
+	c.file = nil
+	return err
+}
+
+// String describes the choice for the startup message.
+func (c *exporterChoice) String() string {
+	if c.prometheus != "" {
+		scraped := "Prometheus at http://" + c.prometheus + "/metrics"
+		if c.kind == exporterNone {
+			return scraped
+		}
+		return c.destination() + " and " + scraped
+	}
+	return c.destination()
+}
+
+func (c *exporterChoice) destination() string {
+	switch c.kind {
+	case exporterOTLP:
+		if c.spool.MaxBytes > 0 {
+			return "OTLP over " + c.protocol + ", spooled to " + c.spool.Dir + " while it's down"
+		}
+		return "OTLP over " + c.protocol
+	case exporterFile:
+		return c.path
+	case exporterConsole:
+		return "stderr"
+	}
+	return "nowhere"
+}
+
+// newSpanExporter builds the exporter for choice. It returns nil for none.
+func newSpanExporter(ctx context.Context, choice *exporterChoice) (sdktrace.SpanExporter, error) {
+	switch choice.kind {
+	case exporterOTLP:
+		client := otlptracehttp.NewClient()
+		if choice.protocol == protocolGRPC {
+			client = otlptracegrpc.NewClient()
+		}
+		if choice.spool.MaxBytes > 0 {
+			spooled, err := newSpool(client, choice.spool)
+			if err != nil {
+				return nil, err
+			}
+			client = spooled
+		}
+		return otlptrace.New(ctx, client)
+	case exporterConsole:
+		return stdouttrace.New(stdouttrace.WithWriter(os.Stderr), stdouttrace.WithPrettyPrint())
+	case exporterFile:
+		w, err := choice.writer()
+		if err != nil {
+			return nil, err
+		}
+		return stdouttrace.New(stdouttrace.WithWriter(w))
+	}
+	return nil, nil
+}
+
+// newMetricExporter builds the exporter for choice. It returns nil for none.
+func newMetricExporter(ctx context.Context, choice *exporterChoice) (sdkmetric.Exporter, error) {
+	switch choice.kind {
+	case exporterOTLP:
+		if choice.protocol == protocolGRPC {
+			return otlpmetricgrpc.New(ctx)
+		}
+		return otlpmetrichttp.New(ctx)
+	case exporterConsole:
+		return stdoutmetric.New(stdoutmetric.WithWriter(os.Stderr), stdoutmetric.WithPrettyPrint())
+	case exporterFile:
+		w, err := choice.writer()
+		if err != nil {
+			return nil, err
+		}
+		return stdoutmetric.New(stdoutmetric.WithWriter(w))
+	}
+	return nil, nil
+}
+
+// newLogExporter builds the exporter for choice. It returns nil for none.
+func newLogExporter(ctx context.Context, choice *exporterChoice) (sdklog.Exporter, error) {
+	switch choice.kind {
+	case exporterOTLP:
+		if choice.protocol == protocolGRPC {
+			return otlploggrpc.New(ctx)
+		}
+		return otlploghttp.New(ctx)
+	case exporterConsole:
+		return stdoutlog.New(stdoutlog.WithWriter(os.Stderr), stdoutlog.WithPrettyPrint())
+	case exporterFile:
+		w, err := choice.writer()
+		if err != nil {
+			return nil, err
+		}
+		return stdoutlog.New(stdoutlog.WithWriter(w))
+	}
+	return nil, nil
+}
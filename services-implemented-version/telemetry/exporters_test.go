@@ -0,0 +1,36 @@
+package telemetry
+
+import "testing"
+
+func TestChooseExporter(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		env       map[string]string
+		kind      string
+		protocol  string
+		defaulted bool
+	}{
+		{"unset goes to a local collector", nil, exporterOTLP, protocolHTTP, true},
+		{"endpoint", map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4318"}, exporterOTLP, protocolHTTP, false},
+		{"signal endpoint", map[string]string{"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT": "http://collector:4318/v1/traces"}, exporterOTLP, protocolHTTP, false},
+		{"grpc", map[string]string{"OTEL_EXPORTER_OTLP_PROTOCOL": "grpc"}, exporterOTLP, protocolGRPC, true},
+		{"none", map[string]string{"OTEL_TRACES_EXPORTER": "none"}, exporterNone, "", false},
+		{"stdout", map[string]string{"OTEL_TRACES_EXPORTER": "stdout"}, exporterConsole, "", false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{"OTEL_TRACES_EXPORTER", "OTEL_EXPORTER_OTLP_ENDPOINT", "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT",
+				"OTEL_EXPORTER_OTLP_PROTOCOL", "OTEL_EXPORTER_OTLP_TRACES_PROTOCOL"} {
+				t.Setenv(name, tt.env[name])
+			}
+			t.Setenv("OTEL_TRACES_SPOOL_MAX_BYTES", "0")
+			choice, err := chooseExporter("test", "traces")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if choice.kind != tt.kind || choice.protocol != tt.protocol || choice.defaulted != tt.defaulted {
+				t.Errorf("got %s %q defaulted=%v, want %s %q defaulted=%v",
+					choice.kind, choice.protocol, choice.defaulted, tt.kind, tt.protocol, tt.defaulted)
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package telemetry
+
+import (
+	"net/http"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	semconv "go.opentelemetry.io/otel/semconv/v1.20.0"
+)
+
+// activeRequests is http.server.active_requests. otelhttp records request counts, durations and
+// sizes, but not how many requests are in flight. The names and attributes follow the semantic
+// conventions otelhttp uses, so the two sets of metrics line up.
+var activeRequests, _ = otel.Meter("telemetry").Int64UpDownCounter("http.server.active_requests",
+	metric.WithUnit("{request}"),
+	metric.WithDescription("Requests being handled"))
+
+// ActiveRequests counts the requests next is handling.
+func ActiveRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		attributes := metric.WithAttributes(RequestAttributes(r)...)
+		activeRequests.Add(ctx, 1, attributes)
+		defer activeRequests.Add(ctx, -1, attributes)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequestAttributes are the attributes every HTTP server metric has: the method and the scheme.
+func RequestAttributes(r *http.Request) []attribute.KeyValue {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	method := r.Method
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+	default:
+		// Keep made-up methods from growing the number of series without bound.
+		method = "_OTHER"
+	}
+	return []attribute.KeyValue{semconv.HTTPMethod(method), semconv.HTTPScheme(scheme)}
+}
+
+// Route is the http.route for a handler registered on pattern: the pattern without the method
+// that http.ServeMux patterns may start with.
+func Route(pattern string) string {
+	if method, path, ok := strings.Cut(pattern, " "); ok && !strings.Contains(method, "/") {
+		return path
+	}
+	return pattern
+}
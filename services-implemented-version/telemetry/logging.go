@@ -0,0 +1,78 @@
+package telemetry
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+
+	"go.opentelemetry.io/contrib/bridges/otelslog"
+	"go.opentelemetry.io/otel/log"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// logLevel reads LOG_LEVEL: debug, info, warn or error. It is info by default.
+func logLevel() (slog.Level, error) {
+	var level slog.Level
+	if value := os.Getenv("LOG_LEVEL"); value != "" {
+		if err := level.UnmarshalText([]byte(value)); err != nil {
+			return level, err
+		}
+	}
+	return level, nil
+}
+
+// logHandler writes records as JSON lines, with the trace_id and span_id of the span in their
+// context, so a log line leads to its trace. With a logger provider, it sends them through the
+// OTel logs SDK as well, where the same IDs are kept as the record's trace context.
+type logHandler struct {
+	level  slog.Leveler
+	json   slog.Handler
+	export slog.Handler // nil unless logs are exported
+}
+
+func newLogHandler(w io.Writer, level slog.Leveler, serviceName string, provider log.LoggerProvider) *logHandler {
+	h := &logHandler{
+		level: level,
+		json:  slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level}),
+	}
+	if provider != nil {
+		h.export = otelslog.NewHandler(serviceName, otelslog.WithLoggerProvider(provider))
+	}
+	return h
+}
+
+func (h *logHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *logHandler) Handle(ctx context.Context, record slog.Record) error {
+	var err error
+	if h.export != nil {
+		err = h.export.Handle(ctx, record.Clone())
+	}
+	if span := trace.SpanContextFromContext(ctx); span.IsValid() {
+		record.AddAttrs(
+			slog.String("trace_id", span.TraceID().String()),
+			slog.String("span_id", span.SpanID().String()),
+		)
+	}
+	return errors.Join(err, h.json.Handle(ctx, record))
+}
+
+func (h *logHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(handler slog.Handler) slog.Handler { return handler.WithAttrs(attrs) })
+}
+
+func (h *logHandler) WithGroup(name string) slog.Handler {
+	return h.with(func(handler slog.Handler) slog.Handler { return handler.WithGroup(name) })
+}
+
+func (h *logHandler) with(apply func(slog.Handler) slog.Handler) slog.Handler {
+	next := &logHandler{level: h.level, json: apply(h.json)}
+	if h.export != nil {
+		next.export = apply(h.export)
+	}
+	return next
+}
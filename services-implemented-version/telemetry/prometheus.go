@@ -0,0 +1,54 @@
+package telemetry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
+	otelprometheus "go.opentelemetry.io/otel/exporters/prometheus"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+)
+
+// prometheusAddress is where to serve /metrics, from OTEL_EXPORTER_PROMETHEUS_HOST and
+// OTEL_EXPORTER_PROMETHEUS_PORT, localhost:9464 by default. In a container, set the host to
+// 0.0.0.0 to scrape from outside it.
+func prometheusAddress() string {
+	host, port := os.Getenv("OTEL_EXPORTER_PROMETHEUS_HOST"), os.Getenv("OTEL_EXPORTER_PROMETHEUS_PORT")
+	if host == "" {
+		host = "localhost"
+	}
+	if port == "" {
+		port = "9464"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// startPrometheus serves metrics for scraping at /metrics on address. It returns the reader to
+// give the meter provider, and a function that stops the server.
+func startPrometheus(address string) (sdkmetric.Reader, func(context.Context) error, error) {
+	registry := prometheus.NewRegistry()
+	reader, err := otelprometheus.New(otelprometheus.WithRegisterer(registry))
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating Prometheus exporter: %w", err)
+	}
+	// Listen before returning, so a port that's taken stops the service from starting.
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, nil, fmt.Errorf("serving Prometheus metrics: %w", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	server := &http.Server{Handler: mux}
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			otel.Handle(fmt.Errorf("serving Prometheus metrics: %w", err))
+		}
+	}()
+	return reader, server.Shutdown, nil
+}
@@ -0,0 +1,57 @@
+package telemetry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/sdk/resource"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// newResource describes the service and where it runs: its name and version, the host, the
+// container and the process. OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES take precedence.
+func newResource(ctx context.Context, serviceName string) (*resource.Resource, error) {
+	res, err := resource.New(ctx,
+		resource.WithAttributes(
+			semconv.ServiceName(serviceName),
+			semconv.ServiceVersion(serviceVersion()),
+		),
+		resource.WithTelemetrySDK(),
+		resource.WithHost(),
+		resource.WithOS(),
+		resource.WithContainer(),
+		resource.WithProcess(),
+		resource.WithFromEnv(),
+	)
+	// Some detectors can't work everywhere, such as the container ID outside a container.
+	// What the others found is still worth having.
+	if errors.Is(err, resource.ErrPartialResource) {
+		otel.Handle(err)
+		err = nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("describing the service: %w", err)
+	}
+	return res, nil
+}
+
+// serviceVersion is the version the binary was built from: its module version if it has one,
+// otherwise the VCS revision.
+func serviceVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if version := info.Main.Version; version != "" && version != "(devel)" {
+		return version
+	}
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" {
+			return setting.Value
+		}
+	}
+	return "unknown"
+}
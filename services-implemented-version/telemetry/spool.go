@@ -0,0 +1,360 @@
+package telemetry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/metric"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	spoolMinBackoff    = time.Second
+	spoolMaxBackoff    = time.Minute
+	spoolReplayTimeout = 30 * time.Second
+	spoolSuffix        = ".pb"
+)
+
+// spoolConfig is where failed span batches wait, and how much room they may take.
+type spoolConfig struct {
+	Dir      string
+	MaxBytes int64 // zero turns spooling off
+}
+
+// spoolConfigFromEnv reads OTEL_TRACES_SPOOL_DIR, by default a directory for the service under
+// the temporary directory, and OTEL_TRACES_SPOOL_MAX_BYTES, 64 MiB by default.
+func spoolConfigFromEnv(serviceName string) (spoolConfig, error) {
+	config := spoolConfig{
+		Dir:      os.Getenv("OTEL_TRACES_SPOOL_DIR"),
+		MaxBytes: 64 << 20,
+	}
+	if config.Dir == "" {
+		config.Dir = filepath.Join(os.TempDir(), "otel-spool", serviceName)
+	}
+	if value := os.Getenv("OTEL_TRACES_SPOOL_MAX_BYTES"); value != "" {
+		maxBytes, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || maxBytes < 0 {
+			return config, fmt.Errorf("OTEL_TRACES_SPOOL_MAX_BYTES=%q: want a number of bytes", value)
+		}
+		config.MaxBytes = maxBytes
+	}
+	return config, nil
+}
+
+// spooledBatch is one batch of spans waiting on disk.
+type spooledBatch struct {
+	name  string
+	size  int64
+	spans int64
+}
+
+// spool keeps the spans an OTLP client couldn't send in a bounded queue on disk, and sends them
+// again, with backoff, once the endpoint is back. Only failures that may pass are spooled; see
+// retryable. While it is failing, new batches go straight to the queue. When the queue is full,
+// the oldest batches make room for new ones. Batches left over when a service stops are sent the
+// next time it starts.
+type spool struct {
+	otlptrace.Client
+	config spoolConfig
+
+	mu      sync.Mutex
+	batches []spooledBatch // oldest first
+	bytes   int64
+	failing bool
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+
+	dropped  metric.Int64Counter
+	replayed metric.Int64Counter
+}
+
+func newSpool(client otlptrace.Client, config spoolConfig) (*spool, error) {
+	if err := os.MkdirAll(config.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating the span spool: %w", err)
+	}
+	s := &spool{
+		Client: client,
+		config: config,
+		wake:   make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	if err := s.load(); err != nil {
+		return nil, fmt.Errorf("reading the span spool: %w", err)
+	}
+
+	meter := otel.Meter("telemetry")
+	s.dropped, _ = meter.Int64Counter("telemetry.spool.dropped",
+		metric.WithUnit("{span}"),
+		metric.WithDescription("Spans given up on because the endpoint refused them, the spool was full, or a spooled batch couldn't be read"))
+	s.replayed, _ = meter.Int64Counter("telemetry.spool.replayed",
+		metric.WithUnit("{span}"),
+		metric.WithDescription("Spooled spans sent once the trace endpoint was back"))
+	meter.Int64ObservableGauge("telemetry.spool.depth",
+		metric.WithUnit("{batch}"),
+		metric.WithDescription("Span batches waiting in the spool"),
+		metric.WithInt64Callback(func(ctx context.Context, o metric.Int64Observer) error {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			o.Observe(int64(len(s.batches)))
+			return nil
+		}))
+	meter.Int64ObservableGauge("telemetry.spool.size",
+		metric.WithUnit("By"),
+		metric.WithDescription("Disk space taken by the spool"),
+		metric.WithInt64Callback(func(ctx context.Context, o metric.Int64Observer) error {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			o.Observe(s.bytes)
+			return nil
+		}))
+	return s, nil
+}
+
+// load picks up batches spooled by an earlier run. Files are named <unix nanos>-<spans>.pb,
+// so sorting them by name puts the oldest first.
+func (s *spool) load() error {
+	entries, err := os.ReadDir(s.config.Dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		_, spans, ok := strings.Cut(strings.TrimSuffix(name, spoolSuffix), "-")
+		count, err := strconv.ParseInt(spans, 10, 64)
+		if !strings.HasSuffix(name, spoolSuffix) || !ok || err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		s.batches = append(s.batches, spooledBatch{name: name, size: info.Size(), spans: count})
+		s.bytes += info.Size()
+	}
+	sort.Slice(s.batches, func(i, j int) bool { return s.batches[i].name < s.batches[j].name })
+	return nil
+}
+
+func (s *spool) Start(ctx context.Context) error {
+	if err := s.Client.Start(ctx); err != nil {
+		return err
+	}
+	go s.replay()
+	return nil
+}
+
+// Stop stops replaying. Whatever is still queued stays on disk for the next run.
+func (s *spool) Stop(ctx context.Context) error {
+	close(s.stop)
+	select {
+	case <-s.done:
+	case <-ctx.Done():
+	}
+	return s.Client.Stop(ctx)
+}
+
+func (s *spool) UploadTraces(ctx context.Context, resourceSpans []*tracepb.ResourceSpans) error {
+	s.mu.Lock()
+	failing := s.failing
+	s.mu.Unlock()
+	if !failing {
+		err := s.Client.UploadTraces(ctx, resourceSpans)
+		if err == nil {
+			return nil
+		}
+		if !retryable(err) {
+			s.dropped.Add(ctx, countSpans(resourceSpans))
+			return err
+		}
+		otel.Handle(fmt.Errorf("can't reach the trace endpoint, spooling spans to %s until it's back: %w", s.config.Dir, err))
+	}
+	if err := s.push(ctx, resourceSpans); err != nil {
+		return fmt.Errorf("spooling spans: %w", err)
+	}
+	return nil
+}
+
+// push adds a batch to the queue, dropping the oldest ones if there isn't room for it.
+func (s *spool) push(ctx context.Context, resourceSpans []*tracepb.ResourceSpans) error {
+	spans := countSpans(resourceSpans)
+	data, err := proto.Marshal(&tracepb.TracesData{ResourceSpans: resourceSpans})
+	if err != nil {
+		s.dropped.Add(ctx, spans)
+		return err
+	}
+	size := int64(len(data))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failing = true
+	defer s.signal()
+	if size > s.config.MaxBytes {
+		s.dropped.Add(ctx, spans)
+		return nil
+	}
+	for len(s.batches) > 0 && s.bytes+size > s.config.MaxBytes {
+		oldest := s.batches[0]
+		os.Remove(filepath.Join(s.config.Dir, oldest.name))
+		s.batches = s.batches[1:]
+		s.bytes -= oldest.size
+		s.dropped.Add(ctx, oldest.spans)
+	}
+
+	// Write through a temporary file, so the replay never reads a batch half written.
+	name := fmt.Sprintf("%020d-%d%s", time.Now().UnixNano(), spans, spoolSuffix)
+	tmp, err := os.CreateTemp(s.config.Dir, ".spool-*")
+	if err != nil {
+		s.dropped.Add(ctx, spans)
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	err = errors.Join(err, tmp.Close())
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(s.config.Dir, name))
+	}
+	if err != nil {
+		s.dropped.Add(ctx, spans)
+		return err
+	}
+	s.batches = append(s.batches, spooledBatch{name: name, size: size, spans: spans})
+	s.bytes += size
+	return nil
+}
+
+// signal wakes the replay without waiting for it.
+func (s *spool) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// replay sends queued batches, oldest first, backing off while the endpoint is still down.
+func (s *spool) replay() {
+	defer close(s.done)
+	backoff := spoolMinBackoff
+	for {
+		s.mu.Lock()
+		batch, ok := spooledBatch{}, len(s.batches) > 0
+		if ok {
+			batch = s.batches[0]
+		}
+		s.mu.Unlock()
+		if !ok {
+			select {
+			case <-s.wake:
+				continue
+			case <-s.stop:
+				return
+			}
+		}
+
+		if err := s.resend(batch); err == nil {
+			backoff = spoolMinBackoff
+			continue
+		}
+		select {
+		case <-time.After(backoff):
+		case <-s.stop:
+			return
+		}
+		backoff = min(backoff*2, spoolMaxBackoff)
+	}
+}
+
+// resend sends one queued batch and takes it off the queue. A batch that can't be read, or that
+// the endpoint refuses for good, is dropped rather than retried, so it doesn't hold up the rest.
+func (s *spool) resend(batch spooledBatch) error {
+	ctx, cancel := context.WithTimeout(context.Background(), spoolReplayTimeout)
+	defer cancel()
+
+	var traces tracepb.TracesData
+	data, err := os.ReadFile(filepath.Join(s.config.Dir, batch.name))
+	if err == nil {
+		err = proto.Unmarshal(data, &traces)
+	}
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			otel.Handle(fmt.Errorf("dropping spooled spans %s: %w", batch.name, err))
+		}
+		s.remove(ctx, batch, s.dropped)
+		return nil
+	}
+	if err := s.Client.UploadTraces(ctx, traces.ResourceSpans); err != nil {
+		if retryable(err) {
+			return err
+		}
+		otel.Handle(fmt.Errorf("dropping spooled spans %s: %w", batch.name, err))
+		s.remove(ctx, batch, s.dropped)
+		return nil
+	}
+	s.remove(ctx, batch, s.replayed)
+	return nil
+}
+
+// retryable reports whether a failed upload may work later: the endpoint couldn't be reached, or
+// it asked to be tried again (429, 502, 503 or 504 over HTTP, and their gRPC equivalents). Other
+// failures, such as 401 for a bad API key or 400, would fail the same way every time.
+func retryable(err error) bool {
+	if s, ok := status.FromError(err); ok {
+		switch s.Code() {
+		case codes.Unavailable, codes.ResourceExhausted, codes.DeadlineExceeded, codes.Aborted:
+			return true
+		}
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	// otlptracehttp's error type for the statuses worth retrying is unexported, so this is the
+	// only way to tell them from the others.
+	return strings.Contains(err.Error(), "retry-able request failure")
+}
+
+// remove takes batch off the queue, counting its spans in counter, unless push already dropped
+// it to make room. The queue is back in use once it is empty.
+func (s *spool) remove(ctx context.Context, batch spooledBatch, counter metric.Int64Counter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.batches) == 0 || s.batches[0].name != batch.name {
+		return
+	}
+	os.Remove(filepath.Join(s.config.Dir, batch.name))
+	s.batches = s.batches[1:]
+	s.bytes -= batch.size
+	counter.Add(ctx, batch.spans)
+	if len(s.batches) == 0 && s.failing {
+		s.failing = false
+		slog.Info("the trace endpoint is back and the span spool is empty")
+	}
+}
+
+func countSpans(resourceSpans []*tracepb.ResourceSpans) int64 {
+	var spans int64
+	for _, rs := range resourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			spans += int64(len(ss.Spans))
+		}
+	}
+	return spans
+}
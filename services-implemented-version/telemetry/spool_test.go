@@ -0,0 +1,229 @@
+package telemetry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// fakeClient records the batches it is sent, failing with err while err is set.
+type fakeClient struct {
+	mu       sync.Mutex
+	err      error
+	uploaded []string // the name of each batch's first span
+}
+
+func (c *fakeClient) Start(context.Context) error { return nil }
+
+func (c *fakeClient) Stop(context.Context) error { return nil }
+
+func (c *fakeClient) UploadTraces(ctx context.Context, resourceSpans []*tracepb.ResourceSpans) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	c.uploaded = append(c.uploaded, resourceSpans[0].ScopeSpans[0].Spans[0].Name)
+	return nil
+}
+
+func (c *fakeClient) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.err = err
+}
+
+func (c *fakeClient) batches() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.uploaded...)
+}
+
+// unreachable is what the OTLP clients return when nothing is listening.
+var unreachable = &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+
+// spans makes a batch of one span, told apart by name.
+func spans(name string) []*tracepb.ResourceSpans {
+	return []*tracepb.ResourceSpans{{
+		ScopeSpans: []*tracepb.ScopeSpans{{
+			Scope: &commonpb.InstrumentationScope{Name: "test"},
+			Spans: []*tracepb.Span{{Name: name, TraceId: make([]byte, 16), SpanId: make([]byte, 8)}},
+		}},
+	}}
+}
+
+func queued(s *spool) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.batches)
+}
+
+func TestSpoolKeepsNewestBatchesWhenFull(t *testing.T) {
+	client := &fakeClient{err: unreachable}
+	// Room for two of these batches, but not three.
+	size := batchSize(t, "batch-0")
+	s, err := newSpool(client, spoolConfig{Dir: t.TempDir(), MaxBytes: 2*size + size/2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"batch-0", "batch-1", "batch-2"} {
+		if err := s.UploadTraces(context.Background(), spans(name)); err != nil {
+			t.Fatalf("UploadTraces(%s) = %v, want it spooled", name, err)
+		}
+	}
+
+	entries, _ := os.ReadDir(s.config.Dir)
+	if len(s.batches) != 2 || len(entries) != 2 {
+		t.Fatalf("%d batches queued and %d files on disk, want 2 of each", len(s.batches), len(entries))
+	}
+	if s.bytes > s.config.MaxBytes {
+		t.Errorf("spool holds %d bytes, more than its %d", s.bytes, s.config.MaxBytes)
+	}
+
+	// Only the two newest are sent once the endpoint is back.
+	client.fail(nil)
+	for len(s.batches) > 0 {
+		if err := s.resend(s.batches[0]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := client.batches(); len(got) != 2 || got[0] != "batch-1" || got[1] != "batch-2" {
+		t.Errorf("sent %v, want [batch-1 batch-2]", got)
+	}
+}
+
+func TestSpoolReloadsOldestFirst(t *testing.T) {
+	dir := t.TempDir()
+	client := &fakeClient{err: unreachable}
+	first, err := newSpool(client, spoolConfig{Dir: dir, MaxBytes: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"batch-0", "batch-1", "batch-2"} {
+		first.UploadTraces(context.Background(), spans(name))
+		// File names are timestamps, so keep them apart.
+		time.Sleep(time.Millisecond)
+	}
+
+	// A spool started later on the same directory picks the batches up, oldest first.
+	client.fail(nil)
+	second, err := newSpool(client, spoolConfig{Dir: dir, MaxBytes: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(second.batches) != 3 || second.bytes != first.bytes {
+		t.Fatalf("reloaded %d batches of %d bytes, want 3 of %d", len(second.batches), second.bytes, first.bytes)
+	}
+	for len(second.batches) > 0 {
+		if err := second.resend(second.batches[0]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := client.batches(); len(got) != 3 || got[0] != "batch-0" || got[1] != "batch-1" || got[2] != "batch-2" {
+		t.Errorf("sent %v, want [batch-0 batch-1 batch-2]", got)
+	}
+}
+
+func TestSpoolReplaysOnceTheEndpointIsBack(t *testing.T) {
+	client := &fakeClient{err: unreachable}
+	s, err := newSpool(client, spoolConfig{Dir: t.TempDir(), MaxBytes: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop(context.Background())
+
+	s.UploadTraces(context.Background(), spans("batch-0"))
+	s.UploadTraces(context.Background(), spans("batch-1"))
+	client.fail(nil)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for queued(s) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d batches still queued", queued(s))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := client.batches(); len(got) != 2 || got[0] != "batch-0" || got[1] != "batch-1" {
+		t.Errorf("sent %v, want [batch-0 batch-1]", got)
+	}
+	entries, _ := os.ReadDir(s.config.Dir)
+	if len(entries) != 0 {
+		t.Errorf("%d files left in the spool", len(entries))
+	}
+
+	// With the queue empty, spans go straight to the endpoint again.
+	s.UploadTraces(context.Background(), spans("batch-2"))
+	if got := client.batches(); len(got) != 3 {
+		t.Errorf("sent %v, want batch-2 sent directly", got)
+	}
+}
+
+func TestSpoolDropsWhatTheEndpointRefuses(t *testing.T) {
+	refused := errors.New("failed to send to http://collector/v1/traces: 401 Unauthorized")
+	client := &fakeClient{err: refused}
+	s, err := newSpool(client, spoolConfig{Dir: t.TempDir(), MaxBytes: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UploadTraces(context.Background(), spans("batch-0")); !errors.Is(err, refused) {
+		t.Errorf("UploadTraces = %v, want %v", err, refused)
+	}
+	if n := queued(s); n != 0 {
+		t.Errorf("%d batches spooled, want none", n)
+	}
+
+	// A batch spooled before the endpoint started refusing is dropped, not retried forever.
+	client.fail(unreachable)
+	s.UploadTraces(context.Background(), spans("batch-1"))
+	client.fail(refused)
+	if err := s.resend(s.batches[0]); err != nil {
+		t.Errorf("resend = %v, want the batch dropped", err)
+	}
+	if n := queued(s); n != 0 {
+		t.Errorf("%d batches still queued, want none", n)
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		want bool
+	}{
+		{unreachable, true},
+		{context.DeadlineExceeded, true},
+		{errors.New("max retry time elapsed: retry-able request failure: 503 Service Unavailable"), true},
+		{errors.New("failed to send to http://collector/v1/traces: 403 Forbidden"), false},
+		{errors.New("failed to send to http://collector/v1/traces: 400 Bad Request"), false},
+		{status.Error(codes.Unavailable, "connection refused"), true},
+		{fmt.Errorf("max retry time elapsed: %w", status.Error(codes.ResourceExhausted, "slow down")), true},
+		{status.Error(codes.Unauthenticated, "bad key"), false},
+	} {
+		if got := retryable(tt.err); got != tt.want {
+			t.Errorf("retryable(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+// batchSize is how much room a batch from spans takes in the spool.
+func batchSize(t *testing.T, name string) int64 {
+	t.Helper()
+	data, err := proto.Marshal(&tracepb.TracesData{ResourceSpans: spans(name)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return int64(len(data))
+}
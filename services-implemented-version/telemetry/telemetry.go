@@ -0,0 +1,146 @@
+// Package telemetry sets up OpenTelemetry the same way in every service: traces, metrics and logs,
+// configured with the standard OTEL_* environment variables. Each signal can go over OTLP (HTTP or
+// gRPC), to stderr, to a JSON-lines file, or nowhere. Start also makes the default slog logger
+// write JSON lines that carry the trace and span IDs of the request being logged.
+package telemetry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/log"
+	"go.opentelemetry.io/otel/log/global"
+	"go.opentelemetry.io/otel/propagation"
+	sdklog "go.opentelemetry.io/otel/sdk/log"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// Start registers global tracer, meter and logger providers for the named service, and the
+// W3C trace context and baggage propagators. OTEL_SERVICE_NAME, if set, overrides the name.
+//
+// The returned function flushes and shuts everything down; call it before the service exits.
+// If Start fails, whatever it had already set up is shut down again.
+func Start(ctx context.Context, serviceName string) (shutdown func(context.Context) error, err error) {
+	var shutdowns []func(context.Context) error
+	shutdown = func(ctx context.Context) error {
+		var errs []error
+		for _, fn := range shutdowns {
+			errs = append(errs, fn(ctx))
+		}
+		shutdowns = nil
+		return errors.Join(errs...)
+	}
+	defer func() {
+		if err != nil {
+			err = errors.Join(err, shutdown(ctx))
+		}
+	}()
+
+	level, err := logLevel()
+	if err != nil {
+		return shutdown, fmt.Errorf("LOG_LEVEL: %w", err)
+	}
+	res, err := newResource(ctx, serviceName)
+	if err != nil {
+		return shutdown, err
+	}
+
+	var choices []*exporterChoice
+	for _, signal := range []string{"traces", "metrics", "logs"} {
+		choice, err := chooseExporter(serviceName, signal)
+		if err != nil {
+			return shutdown, err
+		}
+		choices = append(choices, choice)
+	}
+	traces, metrics, logs := choices[0], choices[1], choices[2]
+
+	// A tracer provider is set up even without an exporter, so that spans still get IDs to
+	// propagate and to record alongside memes.
+	traceExporter, err := newSpanExporter(ctx, traces)
+	if err != nil {
+		return shutdown, fmt.Errorf("creating trace exporter: %w", err)
+	}
+	traceOptions := []sdktrace.TracerProviderOption{sdktrace.WithResource(res)}
+	if traceExporter != nil {
+		traceOptions = append(traceOptions, sdktrace.WithBatcher(traceExporter))
+	}
+	tracerProvider := sdktrace.NewTracerProvider(traceOptions...)
+	shutdowns = append(shutdowns, tracerProvider.Shutdown, traces.close)
+	otel.SetTracerProvider(tracerProvider)
+
+	metricExporter, err := newMetricExporter(ctx, metrics)
+	if err != nil {
+		return shutdown, fmt.Errorf("creating metric exporter: %w", err)
+	}
+	meterOptions := []sdkmetric.Option{sdkmetric.WithResource(res)}
+	if metricExporter != nil {
+		meterOptions = append(meterOptions, sdkmetric.WithReader(sdkmetric.NewPeriodicReader(metricExporter)))
+	}
+	if metrics.prometheus != "" {
+		reader, stopServing, err := startPrometheus(metrics.prometheus)
+		if err != nil {
+			return shutdown, err
+		}
+		shutdowns = append(shutdowns, stopServing)
+		meterOptions = append(meterOptions, sdkmetric.WithReader(reader))
+	}
+	meterProvider := sdkmetric.NewMeterProvider(meterOptions...)
+	shutdowns = append(shutdowns, meterProvider.Shutdown, metrics.close)
+	otel.SetMeterProvider(meterProvider)
+
+	logExporter, err := newLogExporter(ctx, logs)
+	if err != nil {
+		return shutdown, fmt.Errorf("creating log exporter: %w", err)
+	}
+	loggerOptions := []sdklog.LoggerProviderOption{sdklog.WithResource(res)}
+	if logExporter != nil {
+		loggerOptions = append(loggerOptions, sdklog.WithProcessor(sdklog.NewBatchProcessor(logExporter)))
+	}
+	loggerProvider := sdklog.NewLoggerProvider(loggerOptions...)
+	shutdowns = append(shutdowns, loggerProvider.Shutdown, logs.close)
+	global.SetLoggerProvider(loggerProvider)
+
+	// Log JSON lines that carry trace and span IDs, through the logs SDK too if logs go anywhere.
+	// The log package's output goes the same way. OpenTelemetry's own errors are only written
+	// out, so that failing to export logs can't make more logs to export.
+	var exportLogs log.LoggerProvider
+	if logExporter != nil {
+		exportLogs = loggerProvider
+	}
+	slog.SetDefault(slog.New(newLogHandler(os.Stdout, level, serviceName, exportLogs)))
+	local := slog.New(newLogHandler(os.Stdout, level, serviceName, nil))
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		local.Error("opentelemetry", "error", err)
+	}))
+	logChoices(serviceName, choices)
+
+	// Propagate trace context and baggage so a trace carries on across services.
+	otel.SetTextMapPropagator(
+		propagation.NewCompositeTextMapPropagator(
+			propagation.TraceContext{},
+			propagation.Baggage{},
+		),
+	)
+	return shutdown, nil
+}
+
+// logChoices says where each signal is going, so that telemetry never goes missing without a word.
+func logChoices(serviceName string, choices []*exporterChoice) {
+	args := []any{"service", serviceName}
+	defaulted := false
+	for _, choice := range choices {
+		args = append(args, choice.signal, choice.String())
+		defaulted = defaulted || choice.defaulted
+	}
+	slog.Info("telemetry started", args...)
+	if defaulted {
+		slog.Warn("no OTLP endpoint is set, so OTLP goes to a collector on localhost (4318, or 4317 for grpc); " +
+			"set OTEL_EXPORTER_OTLP_ENDPOINT, or OTEL_TRACES_EXPORTER (or _METRICS_, _LOGS_) to console, file or none")
+	}
+}
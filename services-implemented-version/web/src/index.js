@@ -8,47 +8,61 @@
 // });
 // sdk.start();
 
-// Function to fetch the image binary data from the server
-
-async function fetchPicture() {
-    try {
-        // Start with the loading image
-        document.getElementById('picture').style = "display:none";
-        document.getElementById('loading-meme').style = "display:block";
-        document.getElementById('message').innerText = "Generating meme...";
-        document.getElementById('message').style = "display:block";
-
-        const response = await fetch('/backend/createPicture', {
-            method: 'POST',
-            headers: {
-                'Content-Type': 'application/json'
-            },
-            // Optionally, you can send data in the request body if needed
-            // body: JSON.stringify({ /* any data you want to send */ })
-        });
+// Show one line of progress under the button
+function showMessage(text) {
+    document.getElementById('message').innerText = text;
+    document.getElementById('message').style = "display:block";
+}
 
-        if (!response.ok) {
-            throw new Error('Failed to fetch picture');
-        }
+function showError(detail) {
+    console.error('Error fetching picture:', detail);
+    document.getElementById('loading-meme').style = "display:none";
+    document.getElementById('picture').style = "display:none;";
+    showMessage("There was an error fetching a picture. Please retry.");
+}
 
-        // Convert the binary response to a blob
-        const blob = await response.blob();
+// Ask the backend for a meme and follow its progress as Server-Sent Events
+function fetchPicture() {
+    // Start with the loading image
+    document.getElementById('picture').style = "display:none";
+    document.getElementById('loading-meme').style = "display:block";
+    showMessage("Generating meme...");
 
-        // Create a URL for the blob
-        const imgUrl = URL.createObjectURL(blob);
+    // EventSource can't send an Authorization header, so the API key, if the backend wants one, goes in the query
+    const query = process.env.MEMES_API_KEY ? `?access_token=${encodeURIComponent(process.env.MEMES_API_KEY)}` : '';
+    const events = new EventSource(`/backend/createPicture/stream${query}`);
 
-        // Set the image source to the URL
-        document.getElementById('loading-meme').style = "display:none";
-        document.getElementById('message').style = "display:none";
-        document.getElementById('picture').src = imgUrl;
-        document.getElementById('picture').style = "display:block;";
-    } catch (error) {
-        console.error('Error fetching picture:', error);
-        document.getElementById('loading-meme').style = "display:none";
-        document.getElementById('picture').style = "display:none;";
-        document.getElementById('message').innerText = "There was an error fetching a picture. Please retry.";
-        document.getElementById('message').style = "display:block;";
-    }
+    events.addEventListener('phrase', (event) => {
+        showMessage(`Phrase chosen: ${JSON.parse(event.data).phrase}`);
+    });
+    events.addEventListener('image', () => {
+        showMessage("Image chosen...");
+    });
+    events.addEventListener('rendering', () => {
+        showMessage("Rendering...");
+    });
+    events.addEventListener('done', (event) => {
+        events.close();
+        const done = JSON.parse(event.data);
+        const picture = document.getElementById('picture');
+        picture.onload = () => {
+            document.getElementById('loading-meme').style = "display:none";
+            document.getElementById('message').style = "display:none";
+            picture.style = "display:block;";
+        };
+        picture.onerror = () => showError(`could not load ${done.url} (trace ${done.traceId})`);
+        picture.src = done.url;
+    });
+    // The backend sends a problem document when it fails; the browser fires a bare error when the connection drops
+    events.addEventListener('error', (event) => {
+        events.close();
+        if (event.data) {
+            const { problem } = JSON.parse(event.data);
+            showError(`${problem.title} (${problem.code}, trace ${problem.traceId})`);
+        } else {
+            showError('connection to the backend was lost');
+        }
+    });
 }
 
 document.getElementById('go').addEventListener('click', fetchPicture);
\ No newline at end of file